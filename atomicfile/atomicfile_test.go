@@ -0,0 +1,30 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data")
+	os.WriteFile(path, []byte("old content"), 0o644)
+	if err := WriteFile(path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "new" {
+		t.Fatalf("content = %q, %v", data, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("mode = %v, %v", info, err)
+	}
+	// the temporary file is gone
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("entries = %v", entries)
+	}
+
+	if err := WriteFile(filepath.Join(dir, "missing", "data"), nil); err == nil {
+		t.Fatal("WriteFile() into a missing directory succeeded")
+	}
+}
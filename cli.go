@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rindula/msteams-presence-bot-go/token"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// commands are the subcommands of the binary, run is the default.
+var commands = map[string]func(args []string){
+	"run":    runBot,
+	"login":  loginCommand,
+	"logout": logoutCommand,
+	"status": statusCommand,
+	"doctor": doctorCommand,
+}
+
+// commandConfig parses the flags of a subcommand, validates the config with
+// validate and configures the endpoints.
+func commandConfig(flags *flag.FlagSet, args []string, validate func(*Config) error) *Config {
+	config, err := parseConfig(flags, args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err == nil {
+		err = validate(config)
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v\n", err)
+	}
+	if err := configureEndpoints(config); err != nil {
+		log.Fatalln("Invalid endpoint configuration:", err)
+	}
+	return config
+}
+
+// storedTokens returns a token manager for the configured store that never
+// signs in interactively.
+func storedTokens(config *Config) (*token.Manager, error) {
+	store, err := token.NewStore(config.tokenStore())
+	if err != nil {
+		return nil, err
+	}
+	return withoutLogin(store), nil
+}
+
+// withoutLogin returns a token manager for store that never signs in
+// interactively.
+func withoutLogin(store token.TokenStore) *token.Manager {
+	manager := token.NewManager(store, 0)
+	manager.DisableLogin()
+	return manager
+}
+
+// loginCommand signs the user in with the configured flow and exits.
+func loginCommand(args []string) {
+	flags := flag.NewFlagSet("msteams-presence login", flag.ContinueOnError)
+	commandConfig(flags, args, (*Config).validateSignIn)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tokens, err := token.Default()
+	if err != nil {
+		log.Fatalln("Invalid token configuration:", err)
+	}
+	accessToken, err := tokens.Login(ctx)
+	if err != nil {
+		log.Fatalln("Login failed:", err)
+	}
+	me, err := getMe(ctx, graphClient, accessToken.Token)
+	if err != nil {
+		log.Fatalln("Signed in, but requesting the user failed:", err)
+	}
+	fmt.Printf("Signed in as %s (%s)\n", me.DisplayName, me.UserPrincipalName)
+}
+
+// logoutCommand deletes the stored token. The refresh token stays valid at
+// Microsoft until it expires, with -revoke all sign-in sessions of the user
+// are revoked first.
+func logoutCommand(args []string) {
+	flags := flag.NewFlagSet("msteams-presence logout", flag.ContinueOnError)
+	revoke := flags.Bool("revoke", false, "also revoke all refresh tokens of the user, signing them out of every app and device (needs User.RevokeSessions.All); without it a copy of the deleted refresh token stays valid until it expires")
+	config := commandConfig(flags, args, (*Config).validateSignIn)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	store, err := token.NewStore(config.tokenStore())
+	if err != nil {
+		log.Fatalln("Invalid token store:", err)
+	}
+	if *revoke {
+		accessToken, err := withoutLogin(store).Token(ctx)
+		if err != nil {
+			log.Fatalln("Cannot revoke the sign-in sessions without a valid token:", err)
+		}
+		if err := graphRequest(ctx, graphClient, http.MethodPost, "/me/revokeSignInSessions", accessToken.Token, nil, nil); err != nil {
+			log.Fatalln("Error revoking the sign-in sessions:", err)
+		}
+		fmt.Println("Revoked all sign-in sessions")
+	}
+	if err := store.Delete(); err != nil {
+		log.Fatalln("Error deleting the token:", err)
+	}
+	fmt.Println("Deleted the stored token")
+	if !*revoke {
+		fmt.Println("The refresh token remains valid at Microsoft until it expires, use -revoke to invalidate it")
+	}
+}
+
+// statusCommand prints the signed-in user, the presence, the token expiry,
+// the license state and whether the broker is reachable.
+func statusCommand(args []string) {
+	flags := flag.NewFlagSet("msteams-presence status", flag.ContinueOnError)
+	config := commandConfig(flags, args, func(*Config) error { return nil })
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	manager, err := storedTokens(config)
+	var accessToken token.Token
+	if err == nil {
+		accessToken, err = manager.Token(ctx)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "Token:\t%v\n", err)
+	} else {
+		fmt.Fprintf(w, "Token:\tvalid until %s\n", time.Unix(accessToken.ValidUntil, 0).Format(time.RFC1123))
+		if me, err := getMe(ctx, graphClient, accessToken.Token); err != nil {
+			fmt.Fprintf(w, "User:\t%v\n", err)
+		} else {
+			fmt.Fprintf(w, "User:\t%s (%s)\n", me.DisplayName, me.UserPrincipalName)
+		}
+		if presence, err := getPresence(ctx, graphClient, accessToken.Token); err != nil {
+			fmt.Fprintf(w, "Presence:\t%v\n", err)
+		} else {
+			fmt.Fprintf(w, "Presence:\t%s (%s)\n", presence.Availability, presence.Activity)
+			if presence.StatusMessage != nil && presence.StatusMessage.Message.Content != "" {
+				fmt.Fprintf(w, "Status message:\t%s\n", presence.StatusMessage.Message.Content)
+			}
+		}
+	}
+
+	if license, err := checkLicense(ctx, config); err != nil {
+		fmt.Fprintf(w, "License:\t%v\n", err)
+	} else {
+		fmt.Fprintf(w, "License:\t%s\n", license)
+	}
+	if broker, err := checkBroker(config); err != nil {
+		fmt.Fprintf(w, "MQTT:\t%v\n", err)
+	} else {
+		fmt.Fprintf(w, "MQTT:\tconnected to %s\n", broker)
+	}
+}
+
+// checkLicense validates the license and describes the result.
+func checkLicense(ctx context.Context, config *Config) (string, error) {
+	deviceID, err := licenseDeviceID(config.License, false)
+	if err != nil {
+		return "", err
+	}
+	result, err := validateLicense(ctx, &http.Client{Timeout: 15 * time.Second}, licenseServerURL(config.License), config.License.Key, deviceID, licenseRetryPolicy(config.License))
+	if err != nil {
+		return "", err
+	}
+	if !result.Valid {
+		return "", fmt.Errorf("rejected: %s", result.Reason)
+	}
+	description := "valid"
+	if result.Customer != "" {
+		description += " for " + result.Customer
+	}
+	if result.ExpiresAt != nil {
+		description += ", expires " + result.ExpiresAt.Format(time.RFC1123)
+	}
+	return description, nil
+}
+
+// checkBroker connects to the broker once and returns its URL.
+func checkBroker(config *Config) (string, error) {
+	broker, err := mqttBrokerURL(config.MQTT)
+	if err != nil {
+		return "", err
+	}
+	tlsConfig, err := mqttTLSConfig(config.MQTT)
+	if err != nil {
+		return broker.String(), err
+	}
+	opts := mqtt.NewClientOptions().AddBroker(broker.String())
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.SetClientID(fmt.Sprintf("go-presence-bot-check-%v", time.Now().UnixNano()))
+	opts.SetConnectTimeout(10 * time.Second)
+	opts.SetUsername(config.MQTT.User)
+	opts.SetPassword(config.MQTT.Password)
+	client := mqtt.NewClient(opts)
+	connect := client.Connect()
+	if !connect.WaitTimeout(15 * time.Second) {
+		return broker.String(), fmt.Errorf("no connection to %s within 15 seconds", broker)
+	}
+	if err := connect.Error(); err != nil {
+		return broker.String(), fmt.Errorf("connect to %s: %w", broker, err)
+	}
+	client.Disconnect(250)
+	return broker.String(), nil
+}
+
+// tokenClaims decodes the granted delegated scopes and application roles of
+// a JWT access token. The signature is not verified, Graph does that; the
+// claims are only used for diagnostics.
+func tokenClaims(accessToken string) (scopes []string, roles []string, err error) {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return nil, nil, errors.New("the access token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode access token: %w", err)
+	}
+	var claims struct {
+		Scope string   `json:"scp"`
+		Roles []string `json:"roles"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, nil, fmt.Errorf("decode access token: %w", err)
+	}
+	return strings.Fields(claims.Scope), claims.Roles, nil
+}
+
+// doctor prints the result of each check with a hint how to fix failures.
+type doctor struct {
+	w        *tabwriter.Writer
+	failures int
+}
+
+func (d *doctor) ok(check, detail string) {
+	fmt.Fprintf(d.w, "OK\t%s\t%s\n", check, detail)
+}
+
+func (d *doctor) warn(check, detail, hint string) {
+	fmt.Fprintf(d.w, "WARN\t%s\t%s\n\t\t→ %s\n", check, detail, hint)
+}
+
+func (d *doctor) fail(check string, err error, hint string) {
+	d.failures++
+	fmt.Fprintf(d.w, "FAIL\t%s\t%v\n\t\t→ %s\n", check, err, hint)
+}
+
+// doctorCommand checks the configuration, name resolution, the broker, the
+// token and its Graph permissions and the license. It exits with status 1
+// if a check fails.
+func doctorCommand(args []string) {
+	flags := flag.NewFlagSet("msteams-presence doctor", flag.ContinueOnError)
+	config, err := parseConfig(flags, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalln("Invalid configuration:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	d := &doctor{w: tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)}
+
+	if err := config.validate(); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			d.fail("config", errors.New(line), "set it in the config file, the environment or as flag, see -help")
+		}
+	} else {
+		d.ok("config", "all required settings are present")
+	}
+
+	endpoints, err := endpointsFromConfig(config.Microsoft)
+	if err != nil {
+		d.fail("endpoints", err, "check AZURE_CLOUD, AUTHORITY_HOST and GRAPH_URL")
+	} else {
+		configureEndpoints(config)
+		hosts := []string{endpoints.authorityHost, endpoints.graphBaseURL, licenseServerURL(config.License)}
+		if broker, err := mqttBrokerURL(config.MQTT); err == nil {
+			hosts = append(hosts, broker.String())
+		}
+		for _, endpoint := range hosts {
+			host := endpoint
+			if parsed, err := url.Parse(endpoint); err == nil && parsed.Hostname() != "" {
+				host = parsed.Hostname()
+			}
+			if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+				d.fail("dns", err, "check the DNS configuration of this machine or container")
+			} else {
+				d.ok("dns", host)
+			}
+		}
+	}
+
+	if broker, err := checkBroker(config); err != nil {
+		d.fail("mqtt", err, "check MQTT_URL or MQTT_HOST and MQTT_PORT, MQTT_USER, MQTT_PASSWORD and the TLS settings")
+	} else {
+		d.ok("mqtt", "connected to "+broker)
+	}
+
+	d.checkToken(ctx, config)
+
+	if license, err := checkLicense(ctx, config); err != nil {
+		d.fail("license", err, "check LICENSE_KEY, LICENSE_DEVICE_ID and LICENSE_SERVER_URL or request a license")
+	} else {
+		d.ok("license", license)
+	}
+
+	d.w.Flush()
+	if d.failures > 0 {
+		os.Exit(1)
+	}
+}
+
+// checkToken checks that a token is available and grants the permissions the
+// bot needs.
+func (d *doctor) checkToken(ctx context.Context, config *Config) {
+	team := config.Presence.team()
+	var accessToken token.Token
+	var err error
+	if team {
+		accessToken, err = token.GetAppToken(ctx)
+	} else {
+		var manager *token.Manager
+		if manager, err = storedTokens(config); err == nil {
+			accessToken, err = manager.Token(ctx)
+		}
+	}
+	switch {
+	case errors.Is(err, token.ErrInteractionRequired) || errors.Is(err, token.ErrInvalidGrant):
+		d.fail("token", err, "run `msteams-presence login` to sign in again")
+		return
+	case errors.Is(err, token.ErrNetwork):
+		d.fail("token", err, "check the connection to the identity platform")
+		return
+	case err != nil:
+		d.fail("token", err, "check CLIENT_ID, AUTH_TENANT, CLIENT_SECRET and the token store settings")
+		return
+	}
+	if team {
+		d.ok("token", "app-only token received")
+	} else {
+		d.ok("token", "valid until "+time.Unix(accessToken.ValidUntil, 0).Format(time.RFC1123))
+		if !slices.Contains(strings.Fields(strings.ToLower(config.Microsoft.Scopes)), "offline_access") {
+			d.warn("scopes", "GRAPH_USER_SCOPES lacks offline_access", "add offline_access, otherwise no refresh token is issued")
+		}
+	}
+
+	scopes, roles, err := tokenClaims(accessToken.Token)
+	if err != nil {
+		d.warn("scopes", err.Error(), "the permissions cannot be checked, e.g. for personal Microsoft accounts")
+	} else {
+		granted := func(permissions ...string) bool {
+			for _, permission := range permissions {
+				if slices.ContainsFunc(append(scopes, roles...), func(s string) bool { return strings.EqualFold(s, permission) }) {
+					return true
+				}
+			}
+			return false
+		}
+		switch {
+		case team && !granted("Presence.Read.All", "Presence.ReadWrite.All"):
+			d.fail("scopes", errors.New("the app token lacks Presence.Read.All"), "grant the application permission Presence.Read.All with admin consent")
+		case !team && strings.EqualFold(config.Presence.Mode, "subscription") && !granted("Presence.Read.All"):
+			d.fail("scopes", errors.New("the token lacks Presence.Read.All, which presence subscriptions require"), "add Presence.Read.All to GRAPH_USER_SCOPES, grant admin consent and run `msteams-presence login`")
+		case !team && !granted("Presence.Read", "Presence.ReadWrite", "Presence.Read.All"):
+			d.fail("scopes", errors.New("the token lacks Presence.Read"), "add Presence.Read to GRAPH_USER_SCOPES and run `msteams-presence login`")
+		case !team && !granted("Presence.ReadWrite"):
+			d.warn("scopes", "the token lacks Presence.ReadWrite", "add Presence.ReadWrite to set the presence and status message from Home Assistant")
+		default:
+			d.ok("scopes", strings.Join(append(scopes, roles...), " "))
+		}
+	}
+
+	if !team {
+		if me, err := getMe(ctx, graphClient, accessToken.Token); err != nil {
+			d.fail("graph", err, "check GRAPH_URL and that the app registration has User.Read")
+		} else {
+			d.ok("graph", "signed in as "+me.UserPrincipalName)
+		}
+	}
+}
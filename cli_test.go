@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestTokenClaims(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"scp":"Presence.Read User.Read","roles":["Presence.Read.All"]}`))
+	scopes, roles, err := tokenClaims("header." + payload + ".signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(scopes, []string{"Presence.Read", "User.Read"}) || !slices.Equal(roles, []string{"Presence.Read.All"}) {
+		t.Fatalf("scopes = %v, roles = %v", scopes, roles)
+	}
+	if _, _, err := tokenClaims("opaque-token"); err == nil {
+		t.Fatal("opaque token was accepted")
+	}
+}
+
+func TestCheckBroker(t *testing.T) {
+	b := newTestBroker(t)
+	config := &Config{MQTT: MQTTConfig{URL: fmt.Sprintf("tcp://%s", b.address)}}
+	if broker, err := checkBroker(config); err != nil || broker != "tcp://"+b.address {
+		t.Fatalf("checkBroker() = %q, %v", broker, err)
+	}
+
+	b.stop()
+	if _, err := checkBroker(config); err == nil {
+		t.Fatal("stopped broker was reachable")
+	}
+}
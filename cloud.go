@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rindula/msteams-presence-bot-go/token"
+)
+
+type cloudEndpoints struct {
+	authorityHost string
+	graphBaseURL  string
+}
+
+// clouds are the national clouds selectable with AZURE_CLOUD.
+var clouds = map[string]cloudEndpoints{
+	"global":   {authorityHost: "https://login.microsoftonline.com", graphBaseURL: "https://graph.microsoft.com/v1.0"},
+	"usgov":    {authorityHost: "https://login.microsoftonline.us", graphBaseURL: "https://graph.microsoft.us/v1.0"},
+	"usgovdod": {authorityHost: "https://login.microsoftonline.us", graphBaseURL: "https://dod-graph.microsoft.us/v1.0"},
+	"china":    {authorityHost: "https://login.chinacloudapi.cn", graphBaseURL: "https://microsoftgraph.chinacloudapi.cn/v1.0"},
+}
+
+// endpointsFromConfig returns the identity platform and Graph endpoint of the
+// national cloud in config. AuthorityHost and GraphURL override them, e.g. to
+// run against local stand-ins.
+func endpointsFromConfig(config MicrosoftConfig) (cloudEndpoints, error) {
+	name := strings.ToLower(strings.TrimSpace(config.Cloud))
+	if name == "" {
+		name = "global"
+	}
+	endpoints, ok := clouds[name]
+	if !ok {
+		return cloudEndpoints{}, fmt.Errorf("unknown AZURE_CLOUD %q, use global, usgov, usgovdod or china", name)
+	}
+	if config.AuthorityHost != "" {
+		endpoints.authorityHost = config.AuthorityHost
+	}
+	if config.GraphURL != "" {
+		endpoints.graphBaseURL = config.GraphURL
+	}
+	for _, endpoint := range []string{endpoints.authorityHost, endpoints.graphBaseURL} {
+		parsed, err := url.Parse(endpoint)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return cloudEndpoints{}, fmt.Errorf("invalid endpoint %q", endpoint)
+		}
+	}
+	return endpoints, nil
+}
+
+// configureEndpoints applies the endpoints of config to Graph requests and
+// passes them to the token package with the app registration and the token
+// store.
+func configureEndpoints(config *Config) error {
+	endpoints, err := endpointsFromConfig(config.Microsoft)
+	if err != nil {
+		return err
+	}
+	graph, _ := url.Parse(endpoints.graphBaseURL)
+	graphBaseURL = strings.TrimRight(endpoints.graphBaseURL, "/")
+	margin, _ := time.ParseDuration(config.Token.RefreshMargin)
+	token.Configure(token.Config{
+		AuthorityHost: strings.TrimRight(endpoints.authorityHost, "/"),
+		AppScope:      graph.Scheme + "://" + graph.Host + "/.default",
+		HTTPClient:    graphClient,
+		ClientID:      config.secret("CLIENT_ID", config.Microsoft.ClientID),
+		Tenant:        config.secret("AUTH_TENANT", config.Microsoft.Tenant),
+		Scopes:        config.secret("GRAPH_USER_SCOPES", config.Microsoft.Scopes),
+		ClientSecret:  config.secret("CLIENT_SECRET", config.Microsoft.ClientSecret),
+		LoginMode:     config.Microsoft.LoginMode,
+		RedirectPort:  config.Microsoft.RedirectPort,
+		Store:         config.tokenStore(),
+		RefreshMargin: margin,
+	})
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rindula/msteams-presence-bot-go/token"
+)
+
+func TestConfigureEndpoints(t *testing.T) {
+	previousBaseURL := graphBaseURL
+	t.Cleanup(func() {
+		graphBaseURL = previousBaseURL
+		global := clouds["global"]
+		token.Configure(token.Config{AuthorityHost: global.authorityHost, AppScope: "https://graph.microsoft.com/.default", HTTPClient: http.DefaultClient})
+	})
+	config := &Config{Microsoft: MicrosoftConfig{Cloud: "USGov"}}
+	if err := configureEndpoints(config); err != nil || graphBaseURL != "https://graph.microsoft.us/v1.0" {
+		t.Fatalf("configureEndpoints() = %v, graph base URL %s", err, graphBaseURL)
+	}
+	config.Microsoft.Cloud = "mars"
+	if err := configureEndpoints(config); err == nil {
+		t.Fatal("configureEndpoints() accepted an unknown cloud")
+	}
+	config.Microsoft = MicrosoftConfig{GraphURL: "graph.local"}
+	if err := configureEndpoints(config); err == nil {
+		t.Fatal("configureEndpoints() accepted a URL without scheme")
+	}
+
+	// the app token is requested from the configured authority for the
+	// configured Graph resource
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/contoso/oauth2/v2.0/token" || r.Form.Get("scope") != "http://"+r.Host+"/.default" {
+			t.Errorf("unexpected token request %s %v", r.URL, r.Form)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "app", "expires_in": 3600})
+	}))
+	defer server.Close()
+	previousClient := graphClient
+	graphClient = server.Client()
+	defer func() { graphClient = previousClient }()
+	config.Microsoft = MicrosoftConfig{AuthorityHost: server.URL + "/", GraphURL: server.URL + "/v1.0/", Tenant: "contoso", ClientSecret: "secret"}
+	if err := configureEndpoints(config); err != nil {
+		t.Fatal(err)
+	}
+	if graphBaseURL != server.URL+"/v1.0" {
+		t.Fatalf("graph base URL = %s", graphBaseURL)
+	}
+	if appToken, err := token.GetAppToken(t.Context()); err != nil || appToken.Token != "app" {
+		t.Fatalf("GetAppToken() = %+v, %v", appToken, err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rindula/msteams-presence-bot-go/token"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// statusMessageMaxLength is the longest status message Teams accepts.
+const statusMessageMaxLength = 280
+
+// presenceResetOption clears the preferred presence so Teams derives the
+// presence from the activity again.
+const presenceResetOption = "Reset"
+
+// preferredActivities maps the availabilities accepted by
+// setUserPreferredPresence to the matching activity.
+var preferredActivities = map[string]string{
+	"Available":    "Available",
+	"Busy":         "Busy",
+	"DoNotDisturb": "DoNotDisturb",
+	"BeRightBack":  "BeRightBack",
+	"Away":         "Away",
+	"Offline":      "OffWork",
+}
+
+var presenceOptions = []string{"Available", "Busy", "DoNotDisturb", "BeRightBack", "Away", "Offline", presenceResetOption}
+
+// presenceOptionsTemplate renders the presence options as a Jinja list.
+func presenceOptionsTemplate() string {
+	return "['" + strings.Join(presenceOptions, "', '") + "']"
+}
+
+type preferredPresence struct {
+	Availability       string `json:"availability"`
+	Activity           string `json:"activity"`
+	ExpirationDuration string `json:"expirationDuration,omitempty"`
+}
+
+// parsePresenceCommand accepts either a plain option as sent by the Home
+// Assistant select entity or a JSON object with availability, activity and
+// expirationDuration. Without expirationDuration the preferred presence
+// expires after expiration. A nil result clears the preferred presence.
+func parsePresenceCommand(payload []byte, expiration string) (*preferredPresence, error) {
+	command := preferredPresence{}
+	trimmed := strings.TrimSpace(string(payload))
+	if strings.HasPrefix(trimmed, "{") {
+		if err := json.Unmarshal([]byte(trimmed), &command); err != nil {
+			return nil, fmt.Errorf("decode presence command: %w", err)
+		}
+	} else {
+		command.Availability = trimmed
+	}
+	if strings.EqualFold(command.Availability, presenceResetOption) || strings.EqualFold(command.Availability, "clear") {
+		return nil, nil
+	}
+
+	activity, ok := preferredActivities[command.Availability]
+	if !ok {
+		return nil, fmt.Errorf("unsupported availability %q", command.Availability)
+	}
+	if command.Activity == "" {
+		command.Activity = activity
+	}
+	if command.ExpirationDuration == "" {
+		command.ExpirationDuration = expiration
+	}
+	return &command, nil
+}
+
+func setPreferredPresence(ctx context.Context, client *http.Client, accessToken string, presence *preferredPresence) error {
+	if presence == nil {
+		return graphRequest(ctx, client, http.MethodPost, "/me/presence/clearUserPreferredPresence", accessToken, struct{}{}, nil)
+	}
+	return graphRequest(ctx, client, http.MethodPost, "/me/presence/setUserPreferredPresence", accessToken, presence, nil)
+}
+
+// userToken returns the token of the signed-in user.
+func userToken(ctx context.Context) (token.Token, error) {
+	tokens, err := token.Default()
+	if err != nil {
+		return token.Token{}, err
+	}
+	return tokens.Token(ctx)
+}
+
+// handlePresenceCommand sets the preferred presence. It waits for a pending
+// login until ctx is done.
+func handlePresenceCommand(ctx context.Context, msg mqtt.Message, expiration string) {
+	command, err := parsePresenceCommand(msg.Payload(), expiration)
+	if err != nil {
+		log.Println("Ignoring presence command:", err)
+		return
+	}
+	accessToken, err := userToken(ctx)
+	if err != nil {
+		log.Println("Error setting preferred presence:", err)
+		return
+	}
+	requestCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if err := setPreferredPresence(requestCtx, graphClient, accessToken.Token, command); err != nil {
+		log.Println("Error setting preferred presence:", err)
+		return
+	}
+	if command == nil {
+		log.Println("Preferred presence cleared")
+	} else {
+		log.Printf("Preferred presence set to %s/%s\n", command.Availability, command.Activity)
+	}
+}
+
+type statusMessageCommand struct {
+	Message   string     `json:"message"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// parseStatusMessageCommand accepts the plain text sent by the Home Assistant
+// text entity or a JSON object with message and an optional RFC 3339
+// expiresAt. A payload starting with { has to be valid JSON, so a malformed
+// command never ends up as the status message.
+func parseStatusMessageCommand(payload []byte) (StatusMessage, error) {
+	command := statusMessageCommand{Message: string(payload)}
+	if trimmed := strings.TrimSpace(string(payload)); strings.HasPrefix(trimmed, "{") {
+		command = statusMessageCommand{}
+		if err := json.Unmarshal([]byte(trimmed), &command); err != nil {
+			return StatusMessage{}, fmt.Errorf("invalid status message command: %w", err)
+		}
+	}
+	command.Message = strings.TrimSpace(command.Message)
+	if len([]rune(command.Message)) > statusMessageMaxLength {
+		return StatusMessage{}, fmt.Errorf("status message is longer than %d characters", statusMessageMaxLength)
+	}
+
+	statusMessage := StatusMessage{Message: Message{Content: command.Message, ContentType: "text"}}
+	if command.ExpiresAt != nil {
+		if command.ExpiresAt.Before(time.Now()) {
+			return StatusMessage{}, fmt.Errorf("status message expiry %s is in the past", command.ExpiresAt.Format(time.RFC3339))
+		}
+		statusMessage.ExpiryDateTime = &DateTimeTimeZone{
+			DateTime: command.ExpiresAt.UTC().Format("2006-01-02T15:04:05"),
+			TimeZone: "UTC",
+		}
+	}
+	return statusMessage, nil
+}
+
+// setStatusMessage sets the Teams status message. An empty message clears it.
+func setStatusMessage(ctx context.Context, client *http.Client, accessToken string, statusMessage StatusMessage) error {
+	request := struct {
+		StatusMessage StatusMessage `json:"statusMessage"`
+	}{StatusMessage: statusMessage}
+	return graphRequest(ctx, client, http.MethodPost, "/me/presence/setStatusMessage", accessToken, request, nil)
+}
+
+func handleStatusMessageCommand(ctx context.Context, msg mqtt.Message) {
+	statusMessage, err := parseStatusMessageCommand(msg.Payload())
+	if err != nil {
+		log.Println("Ignoring status message command:", err)
+		return
+	}
+	updateStatusMessage(ctx, statusMessage)
+}
+
+func handleStatusMessageClear(ctx context.Context, msg mqtt.Message) {
+	updateStatusMessage(ctx, StatusMessage{Message: Message{Content: "", ContentType: "text"}})
+}
+
+func updateStatusMessage(ctx context.Context, statusMessage StatusMessage) {
+	accessToken, err := userToken(ctx)
+	if err != nil {
+		log.Println("Error setting status message:", err)
+		return
+	}
+	requestCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if err := setStatusMessage(requestCtx, graphClient, accessToken.Token, statusMessage); err != nil {
+		log.Println("Error setting status message:", err)
+		return
+	}
+	if statusMessage.Message.Content == "" {
+		log.Println("Status message cleared")
+	} else {
+		log.Println("Status message set to", statusMessage.Message.Content)
+	}
+}
+
+// subscribeCommands subscribes to the command topics. It is called on every
+// connect, because the subscriptions do not survive a new session. The
+// commands are cancelled when ctx is done.
+func subscribeCommands(ctx context.Context, client mqtt.Client, topics Topics, config PresenceConfig) {
+	client.Subscribe(topics.PresenceCommand(), 1, func(client mqtt.Client, msg mqtt.Message) {
+		// handle the command outside of the paho callback, which must not block
+		go handlePresenceCommand(ctx, msg, config.ExpirationDuration)
+	})
+	client.Subscribe(topics.StatusMessageCommand(), 1, func(client mqtt.Client, msg mqtt.Message) {
+		go handleStatusMessageCommand(ctx, msg)
+	})
+	client.Subscribe(topics.StatusMessageClear(), 1, func(client mqtt.Client, msg mqtt.Message) {
+		go handleStatusMessageClear(ctx, msg)
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePresenceCommand(t *testing.T) {
+	command, err := parsePresenceCommand([]byte("Offline"), "PT1H")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *command != (preferredPresence{Availability: "Offline", Activity: "OffWork", ExpirationDuration: "PT1H"}) {
+		t.Fatalf("command = %+v", command)
+	}
+
+	command, err = parsePresenceCommand([]byte(`{"availability":"Busy","activity":"InACall","expirationDuration":"PT5M"}`), "PT1H")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *command != (preferredPresence{Availability: "Busy", Activity: "InACall", ExpirationDuration: "PT5M"}) {
+		t.Fatalf("command = %+v", command)
+	}
+
+	if command, err := parsePresenceCommand([]byte(presenceResetOption), ""); err != nil || command != nil {
+		t.Fatalf("reset = %+v, %v", command, err)
+	}
+	if _, err := parsePresenceCommand([]byte("Sleeping"), ""); err == nil {
+		t.Fatal("unsupported availability was accepted")
+	}
+}
+
+func TestSetPreferredPresence(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer access" {
+			t.Fatalf("request = %s %v", r.Method, r.Header)
+		}
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/me/presence/setUserPreferredPresence" {
+			var body preferredPresence
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Availability != "DoNotDisturb" || body.Activity != "DoNotDisturb" {
+				t.Fatalf("body = %+v", body)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	previousBaseURL := graphBaseURL
+	graphBaseURL = server.URL
+	defer func() { graphBaseURL = previousBaseURL }()
+
+	command := &preferredPresence{Availability: "DoNotDisturb", Activity: "DoNotDisturb"}
+	if err := setPreferredPresence(t.Context(), server.Client(), "access", command); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPreferredPresence(t.Context(), server.Client(), "access", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[1] != "/me/presence/clearUserPreferredPresence" {
+		t.Fatalf("paths = %v", paths)
+	}
+}
+
+func TestParseStatusMessageCommand(t *testing.T) {
+	statusMessage, err := parseStatusMessageCommand([]byte(" In the lab "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusMessage.Message.Content != "In the lab" || statusMessage.ExpiryDateTime != nil {
+		t.Fatalf("status message = %+v", statusMessage)
+	}
+
+	expiry := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+	statusMessage, err = parseStatusMessageCommand([]byte(`{"message":"In the lab until 3pm","expiresAt":"` + expiry.Format(time.RFC3339) + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusMessage.Message.Content != "In the lab until 3pm" || statusMessage.ExpiryDateTime == nil {
+		t.Fatalf("status message = %+v", statusMessage)
+	}
+	if want := (DateTimeTimeZone{DateTime: expiry.Format("2006-01-02T15:04:05"), TimeZone: "UTC"}); *statusMessage.ExpiryDateTime != want {
+		t.Fatalf("expiry = %+v, want %+v", statusMessage.ExpiryDateTime, want)
+	}
+
+	if _, err := parseStatusMessageCommand([]byte(`{"message":"late","expiresAt":"2000-01-01T00:00:00Z"}`)); err == nil {
+		t.Fatal("expiry in the past was accepted")
+	}
+	if _, err := parseStatusMessageCommand([]byte(`{"message":"In the lab"`)); err == nil {
+		t.Fatal("malformed JSON was accepted")
+	}
+	if _, err := parseStatusMessageCommand([]byte(`{"message":"In the lab","expiresAt":"3pm"}`)); err == nil {
+		t.Fatal("expiry that is not RFC 3339 was accepted")
+	}
+	if _, err := parseStatusMessageCommand([]byte(strings.Repeat("x", statusMessageMaxLength+1))); err == nil {
+		t.Fatal("overlong status message was accepted")
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rindula/msteams-presence-bot-go/secret"
+	"github.com/rindula/msteams-presence-bot-go/token"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigFile = "config.yaml"
+
+// Config holds the settings of the bot. Every setting can be given in the
+// config file, as environment variable, as file named by the environment
+// variable with the suffix _FILE and as flag. Flags take precedence over
+// environment variables, which take precedence over the file.
+type Config struct {
+	// flagged holds the environment names of settings given as flag.
+	flagged map[string]bool
+	// fromFile holds the environment names of settings read from a secret
+	// file named by the variable with the suffix _FILE.
+	fromFile map[string]bool
+
+	Microsoft     MicrosoftConfig     `yaml:"microsoft"`
+	MQTT          MQTTConfig          `yaml:"mqtt"`
+	HomeAssistant HomeAssistantConfig `yaml:"homeassistant"`
+	Presence      PresenceConfig      `yaml:"presence"`
+	Token         TokenConfig         `yaml:"token"`
+	License       LicenseConfig       `yaml:"license"`
+}
+
+type MicrosoftConfig struct {
+	ClientID      string `yaml:"client_id" env:"CLIENT_ID" usage:"application (client) ID of the app registration"`
+	Tenant        string `yaml:"tenant" env:"AUTH_TENANT" default:"common" usage:"tenant ID, or common/organizations for the signed-in user"`
+	Scopes        string `yaml:"scopes" env:"GRAPH_USER_SCOPES" default:"user.read offline_access" usage:"delegated Graph scopes, e.g. 'Presence.Read offline_access'"`
+	ClientSecret  string `yaml:"client_secret" env:"CLIENT_SECRET" usage:"client secret for app-only access to several users"`
+	Cloud         string `yaml:"cloud" env:"AZURE_CLOUD" usage:"national cloud: global, usgov, usgovdod or china"`
+	AuthorityHost string `yaml:"authority_host" env:"AUTHORITY_HOST" usage:"identity platform URL overriding the cloud"`
+	GraphURL      string `yaml:"graph_url" env:"GRAPH_URL" usage:"Graph base URL including the version, overriding the cloud"`
+	LoginMode     string `yaml:"login_mode" env:"LOGIN_MODE" usage:"interactive login: device or browser"`
+	RedirectPort  string `yaml:"redirect_port" env:"LOGIN_REDIRECT_PORT" usage:"loopback port of the browser login"`
+}
+
+type MQTTConfig struct {
+	URL            string `yaml:"url" env:"MQTT_URL" usage:"broker URL, e.g. mqtts://broker.example.com"`
+	Host           string `yaml:"host" env:"MQTT_HOST" usage:"broker host if no URL is given"`
+	Port           string `yaml:"port" env:"MQTT_PORT" usage:"broker port if no URL is given (default 1883)"`
+	User           string `yaml:"user" env:"MQTT_USER" usage:"broker user name"`
+	Password       string `yaml:"password" env:"MQTT_PASSWORD" usage:"broker password"`
+	CAFile         string `yaml:"ca_file" env:"MQTT_CA_FILE" usage:"PEM file with additional CA certificates"`
+	ClientCertFile string `yaml:"client_cert_file" env:"MQTT_CLIENT_CERT_FILE" usage:"client certificate for mutual TLS"`
+	ClientKeyFile  string `yaml:"client_key_file" env:"MQTT_CLIENT_KEY_FILE" usage:"client key for mutual TLS"`
+	TLSInsecure    string `yaml:"tls_insecure" env:"MQTT_TLS_INSECURE" usage:"skip the verification of the broker certificate"`
+	BaseTopic      string `yaml:"base_topic" env:"MQTT_BASE_TOPIC" usage:"prefix of all state and command topics"`
+}
+
+type HomeAssistantConfig struct {
+	DiscoveryPrefix   string `yaml:"discovery_prefix" env:"HA_DISCOVERY_PREFIX" usage:"Home Assistant discovery prefix"`
+	NodeID            string `yaml:"node_id" env:"HA_NODE_ID" usage:"node ID of discovery topics and unique IDs"`
+	HeartbeatInterval string `yaml:"heartbeat_interval" env:"HEARTBEAT_INTERVAL" usage:"seconds between publications of an unchanged state"`
+}
+
+type PresenceConfig struct {
+	Mode               string `yaml:"mode" env:"PRESENCE_MODE" usage:"poll or subscription"`
+	Users              string `yaml:"users" env:"PRESENCE_USERS" usage:"users to monitor with an app-only token"`
+	Groups             string `yaml:"groups" env:"PRESENCE_GROUPS" usage:"groups whose members are monitored with an app-only token"`
+	TeamPollInterval   string `yaml:"team_poll_interval" env:"TEAM_POLL_INTERVAL" default:"30s" usage:"interval between presence requests for PRESENCE_USERS and PRESENCE_GROUPS"`
+	ExpirationDuration string `yaml:"expiration_duration" env:"PRESENCE_EXPIRATION_DURATION" usage:"ISO 8601 duration of a presence set from Home Assistant"`
+	WebhookURL         string `yaml:"webhook_url" env:"WEBHOOK_URL" usage:"public HTTPS URL of the webhook for subscriptions"`
+	WebhookListen      string `yaml:"webhook_listen" env:"WEBHOOK_LISTEN" usage:"listen address of the webhook"`
+	WebhookTLSCert     string `yaml:"webhook_tls_cert" env:"WEBHOOK_TLS_CERT" usage:"certificate of the webhook"`
+	WebhookTLSKey      string `yaml:"webhook_tls_key" env:"WEBHOOK_TLS_KEY" usage:"key of the webhook"`
+}
+
+type TokenConfig struct {
+	Store         string `yaml:"store" env:"TOKEN_STORE" usage:"token store: file, secret or memory"`
+	SecretDir     string `yaml:"secret_dir" env:"TOKEN_SECRET_DIR" usage:"directory of the secret token store"`
+	Passphrase    string `yaml:"passphrase" env:"TOKEN_PASSPHRASE" usage:"passphrase of the token file"`
+	KeyFile       string `yaml:"key_file" env:"TOKEN_KEY_FILE" usage:"key file of the token file"`
+	RefreshMargin string `yaml:"refresh_margin" env:"TOKEN_REFRESH_MARGIN" default:"5m" usage:"how long before expiry the token is refreshed"`
+}
+
+type LicenseConfig struct {
+	Key            string `yaml:"key" env:"LICENSE_KEY" usage:"license key"`
+	ServerURL      string `yaml:"server_url" env:"LICENSE_SERVER_URL" usage:"license server, e.g. an on-premises mirror"`
+	DeviceID       string `yaml:"device_id" env:"LICENSE_DEVICE_ID" usage:"stable ID of this installation, derived from the device ID source if empty"`
+	DeviceIDSource string `yaml:"device_id_source" env:"LICENSE_DEVICE_ID_SOURCE" usage:"source of the derived device ID: auto, machine-id, generated or hostname"`
+	DeviceFile     string `yaml:"device_file" env:"LICENSE_DEVICE_FILE" usage:"file keeping the derived device ID"`
+	CacheFile      string `yaml:"cache_file" env:"LICENSE_CACHE_FILE" usage:"file caching the signed license for offline use"`
+	GracePeriod    string `yaml:"grace_period" env:"LICENSE_GRACE_PERIOD" usage:"how long a cached license is accepted while the license server is unreachable, 0 disables it"`
+	WarningDays    string `yaml:"warning_days" env:"LICENSE_WARNING_DAYS" usage:"days before the license expires to publish a warning event, 0 disables it"`
+	RetryAttempts  string `yaml:"retry_attempts" env:"LICENSE_RETRY_ATTEMPTS" default:"4" usage:"requests per license check while the license server is unavailable, 1 disables retries"`
+	RetryDelay     string `yaml:"retry_delay" env:"LICENSE_RETRY_DELAY" default:"1s" usage:"pause before the first retry of a license request, doubled for every further retry"`
+}
+
+// setting is a string field of Config with its names in the config file, the
+// environment and the command line, and its default value.
+type setting struct {
+	path  string
+	env   string
+	def   string
+	usage string
+	value *string
+}
+
+func (s setting) flag() string {
+	return strings.ToLower(strings.ReplaceAll(s.env, "_", "-"))
+}
+
+// describe names the setting in all sources for error messages.
+func (s setting) describe() string {
+	return fmt.Sprintf("%s (%s in the config file, -%s)", s.env, s.path, s.flag())
+}
+
+func (c *Config) settings() []setting {
+	var settings []setting
+	var walk func(value reflect.Value, prefix string)
+	walk = func(value reflect.Value, prefix string) {
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			path := prefix + field.Tag.Get("yaml")
+			if field.Type.Kind() == reflect.Struct {
+				walk(value.Field(i), path+".")
+				continue
+			}
+			settings = append(settings, setting{path: path, env: field.Tag.Get("env"), def: field.Tag.Get("default"), usage: field.Tag.Get("usage"), value: value.Field(i).Addr().Interface().(*string)})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return settings
+}
+
+// loadConfig reads and validates the config of the bot.
+func loadConfig(args []string) (*Config, error) {
+	config, err := parseConfig(flag.NewFlagSet("msteams-presence", flag.ContinueOnError), args)
+	if err != nil {
+		return nil, err
+	}
+	return config, config.validate()
+}
+
+// parseConfig reads the config file given with -config, CONFIG_FILE or
+// config.yaml if it exists, and applies the environment and the flags in
+// args. Subcommands can add their own flags to flags beforehand.
+func parseConfig(flags *flag.FlagSet, args []string) (*Config, error) {
+	config := &Config{}
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML config file (default "+defaultConfigFile+" if it exists)")
+	settings := config.settings()
+	byFlag := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byFlag[s.flag()] = s
+		flags.String(s.flag(), s.def, s.usage+" ("+s.env+")")
+		*s.value = s.def
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", flags.Args())
+	}
+
+	path := *configFile
+	if _, err := os.Stat(defaultConfigFile); path == "" && err == nil {
+		path = defaultConfigFile
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	var errs []error
+	config.fromFile = map[string]bool{}
+	for _, s := range settings {
+		value, err := secret.Lookup(s.env)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if value != "" {
+			*s.value = value
+			config.fromFile[s.env] = os.Getenv(s.env+"_FILE") != ""
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	config.flagged = map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		if s, ok := byFlag[f.Name]; ok {
+			*s.value = f.Value.String()
+			config.flagged[s.env] = true
+			delete(config.fromFile, s.env)
+		}
+	})
+	for _, s := range settings {
+		*s.value = strings.TrimSpace(*s.value)
+	}
+	return config, nil
+}
+
+// validate reports all invalid settings at once.
+func (c *Config) validate() error {
+	return c.check(true)
+}
+
+// validateSignIn only requires the settings needed to sign in.
+func (c *Config) validateSignIn() error {
+	return c.check(false)
+}
+
+func (c *Config) check(bot bool) error {
+	settings := map[string]setting{}
+	for _, s := range c.settings() {
+		settings[s.env] = s
+	}
+	var errs []error
+	require := func(env string) {
+		if s := settings[env]; *s.value == "" {
+			errs = append(errs, fmt.Errorf("%s is required: %s", s.describe(), s.usage))
+		}
+	}
+	check := func(env string, valid func(string) bool, expected string) {
+		if s := settings[env]; *s.value != "" && !valid(*s.value) {
+			errs = append(errs, fmt.Errorf("%s %q is invalid: expected %s", s.describe(), *s.value, expected))
+		}
+	}
+	oneOf := func(values ...string) func(string) bool {
+		return func(value string) bool {
+			for _, v := range values {
+				if strings.EqualFold(value, v) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	require("CLIENT_ID")
+	require("AUTH_TENANT")
+	if !bot || !c.Presence.team() {
+		require("GRAPH_USER_SCOPES")
+	} else {
+		require("CLIENT_SECRET")
+	}
+	if strings.EqualFold(c.Token.Store, "secret") {
+		require("TOKEN_SECRET_DIR")
+	}
+	if bot {
+		if c.MQTT.URL == "" {
+			require("MQTT_HOST")
+		}
+		require("MQTT_USER")
+		require("MQTT_PASSWORD")
+		require("LICENSE_KEY")
+		switch {
+		case strings.EqualFold(c.Presence.Mode, "subscription") && c.Presence.team():
+			errs = append(errs, fmt.Errorf("%s subscription is not supported with PRESENCE_USERS or PRESENCE_GROUPS, the team is polled", settings["PRESENCE_MODE"].describe()))
+		case strings.EqualFold(c.Presence.Mode, "subscription"):
+			require("WEBHOOK_URL")
+		}
+	}
+
+	check("MQTT_PORT", func(value string) bool {
+		port, err := strconv.Atoi(value)
+		return err == nil && port > 0 && port < 65536
+	}, "a port number")
+	check("MQTT_TLS_INSECURE", func(value string) bool {
+		_, err := strconv.ParseBool(value)
+		return err == nil
+	}, "true or false")
+	check("HEARTBEAT_INTERVAL", func(value string) bool {
+		seconds, err := strconv.Atoi(value)
+		return err == nil && seconds > 0 && seconds < int(expiration)
+	}, fmt.Sprintf("seconds below %d", expiration))
+	check("TEAM_POLL_INTERVAL", func(value string) bool {
+		d, err := time.ParseDuration(value)
+		return err == nil && d >= time.Second && d < time.Duration(expiration)*time.Second
+	}, fmt.Sprintf("a duration from 1s to below %ds like 30s", expiration))
+	check("TOKEN_REFRESH_MARGIN", func(value string) bool {
+		d, err := time.ParseDuration(value)
+		return err == nil && d >= 0 && d < time.Hour
+	}, "a duration below 1h like 5m")
+	check("LICENSE_SERVER_URL", func(value string) bool {
+		parsed, err := url.Parse(value)
+		return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+	}, "an http or https URL")
+	check("LICENSE_GRACE_PERIOD", func(value string) bool {
+		d, err := time.ParseDuration(value)
+		return err == nil && d >= 0
+	}, "a duration like 72h")
+	check("LICENSE_WARNING_DAYS", func(value string) bool {
+		days, err := strconv.Atoi(value)
+		return err == nil && days >= 0
+	}, "a number of days")
+	check("LICENSE_RETRY_ATTEMPTS", func(value string) bool {
+		attempts, err := strconv.Atoi(value)
+		return err == nil && attempts >= 1
+	}, "a number of attempts of at least 1")
+	check("LICENSE_RETRY_DELAY", func(value string) bool {
+		d, err := time.ParseDuration(value)
+		return err == nil && d > 0 && d <= licenseRequestTimeout
+	}, "a duration like 1s")
+	check("AZURE_CLOUD", func(value string) bool {
+		_, ok := clouds[strings.ToLower(value)]
+		return ok
+	}, "global, usgov, usgovdod or china")
+	check("PRESENCE_MODE", oneOf("poll", "subscription"), "poll or subscription")
+	check("LICENSE_DEVICE_ID_SOURCE", oneOf("auto", "machine-id", "generated", "hostname"), "auto, machine-id, generated or hostname")
+	check("LOGIN_MODE", oneOf("device", "browser"), "device or browser")
+	check("TOKEN_STORE", oneOf("file", "secret", "memory"), "file, secret or memory")
+	return errors.Join(errs...)
+}
+
+// secret returns a function returning value, the setting env. A setting
+// read from a secret file is returned by secret.Get.
+func (c *Config) secret(env, value string) func() string {
+	if c.fromFile[env] {
+		return func() string { return secret.Get(env) }
+	}
+	return func() string { return value }
+}
+
+// tokenStore returns the settings of the token store.
+func (c *Config) tokenStore() token.StoreConfig {
+	return token.StoreConfig{
+		Kind:       c.Token.Store,
+		SecretDir:  c.Token.SecretDir,
+		Passphrase: c.secret("TOKEN_PASSPHRASE", c.Token.Passphrase),
+		KeyFile:    c.Token.KeyFile,
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// clearConfigEnv unsets all settings for the duration of the test.
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	for _, s := range (&Config{}).settings() {
+		t.Setenv(s.env, "")
+		t.Setenv(s.env+"_FILE", "")
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const validConfigFile = `
+microsoft:
+  client_id: file-client
+  tenant: contoso
+  scopes: Presence.Read offline_access
+mqtt:
+  host: file-broker
+  port: 1884
+  user: bot
+  password: secret
+license:
+  key: KEY
+`
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, validConfigFile)
+	t.Setenv("MQTT_HOST", "env-broker")
+	t.Setenv("MQTT_USER", "env-user")
+
+	config, err := loadConfig([]string{"-config", path, "-mqtt-user", "flag-user", "-presence-mode", "poll"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Microsoft.ClientID != "file-client" || config.MQTT.Port != "1884" {
+		t.Fatalf("file settings = %+v", config)
+	}
+	if config.MQTT.Host != "env-broker" {
+		t.Fatalf("MQTT host = %q, want the environment to override the file", config.MQTT.Host)
+	}
+	if config.MQTT.User != "flag-user" || config.Presence.Mode != "poll" {
+		t.Fatalf("flag settings = %+v", config)
+	}
+
+	if os.Getenv("CLIENT_ID") != "" || os.Getenv("MQTT_USER") != "env-user" {
+		t.Fatalf("loadConfig() changed the environment: CLIENT_ID = %q, MQTT_USER = %q", os.Getenv("CLIENT_ID"), os.Getenv("MQTT_USER"))
+	}
+}
+
+func TestLoadConfigFromEnvironment(t *testing.T) {
+	clearConfigEnv(t)
+	t.Chdir(t.TempDir())
+	for env, value := range map[string]string{
+		"CLIENT_ID": "client", "AUTH_TENANT": "contoso", "GRAPH_USER_SCOPES": "Presence.Read",
+		"MQTT_URL": "mqtts://broker", "MQTT_USER": "bot", "MQTT_PASSWORD": "secret", "LICENSE_KEY": "KEY",
+	} {
+		t.Setenv(env, value)
+	}
+	config, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MQTT.URL != "mqtts://broker" {
+		t.Fatalf("config = %+v", config)
+	}
+	if _, err := os.Stat(".env"); !os.IsNotExist(err) {
+		t.Fatal("loadConfig wrote a .env file")
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	clearConfigEnv(t)
+	t.Chdir(t.TempDir())
+	t.Setenv("CLIENT_ID", "client")
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Microsoft.Tenant != "common" || config.Microsoft.Scopes != "user.read offline_access" {
+		t.Fatalf("defaults = %+v", config.Microsoft)
+	}
+	if err := config.validateSignIn(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a secret file replaces a default
+	tenantFile := filepath.Join(t.TempDir(), "tenant")
+	os.WriteFile(tenantFile, []byte("contoso\n"), 0o600)
+	t.Setenv("AUTH_TENANT_FILE", tenantFile)
+	if config, err = parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), nil); err != nil || config.Microsoft.Tenant != "contoso" {
+		t.Fatalf("tenant = %q, %v", config.Microsoft.Tenant, err)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	clearConfigEnv(t)
+	t.Chdir(t.TempDir())
+	_, err := loadConfig([]string{"-mqtt-port", "http", "-presence-mode", "subscription", "-token-refresh-margin", "90m", "-token-store", "secret", "-team-poll-interval", "5m", "-license-retry-attempts", "0"})
+	if err == nil {
+		t.Fatal("loadConfig() accepted an empty configuration")
+	}
+	for _, message := range []string{
+		"CLIENT_ID (microsoft.client_id in the config file, -client-id) is required",
+		"MQTT_HOST", "TOKEN_SECRET_DIR", "MQTT_USER", "MQTT_PASSWORD", "LICENSE_KEY", "WEBHOOK_URL",
+		`MQTT_PORT (mqtt.port in the config file, -mqtt-port) "http" is invalid: expected a port number`,
+		`TOKEN_REFRESH_MARGIN (token.refresh_margin in the config file, -token-refresh-margin) "90m" is invalid`,
+		`TEAM_POLL_INTERVAL (presence.team_poll_interval in the config file, -team-poll-interval) "5m" is invalid`,
+		`LICENSE_RETRY_ATTEMPTS (license.retry_attempts in the config file, -license-retry-attempts) "0" is invalid`,
+	} {
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("error does not mention %q:\n%v", message, err)
+		}
+	}
+
+	// app-only access needs a client secret instead of delegated scopes
+	path := writeConfigFile(t, strings.Replace(validConfigFile, "  scopes: Presence.Read offline_access\n", "", 1))
+	_, err = loadConfig([]string{"-config", path, "-presence-users", "jane@contoso.com"})
+	if err == nil || !strings.Contains(err.Error(), "CLIENT_SECRET") || strings.Contains(err.Error(), "GRAPH_USER_SCOPES") {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	// the team is polled, subscriptions are only available for the signed-in user
+	_, err = loadConfig([]string{"-config", path, "-presence-users", "jane@contoso.com", "-presence-mode", "subscription"})
+	if err == nil || !strings.Contains(err.Error(), "PRESENCE_MODE (presence.mode in the config file, -presence-mode) subscription is not supported") || strings.Contains(err.Error(), "WEBHOOK_URL") {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+}
+
+func TestLoadConfigRejectsUnknownFields(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, validConfigFile+"mqtt_host: typo\n")
+	if _, err := loadConfig([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "mqtt_host") {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+}
+
+func TestLoadConfigFromSecretFiles(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, validConfigFile)
+	passwordFile := filepath.Join(t.TempDir(), "mqtt_password")
+	os.WriteFile(passwordFile, []byte("from-secret\n"), 0o600)
+	t.Setenv("MQTT_PASSWORD_FILE", passwordFile)
+	config, err := loadConfig([]string{"-config", path})
+	if err != nil || config.MQTT.Password != "from-secret" {
+		t.Fatalf("loadConfig() = %+v, %v", config, err)
+	}
+
+	// a rotated secret file applies without loading the config again
+	password := config.secret("MQTT_PASSWORD", config.MQTT.Password)
+	os.WriteFile(passwordFile, []byte("rotated-secret\n"), 0o600)
+	if got := password(); got != "rotated-secret" {
+		t.Fatalf("rotated password = %q", got)
+	}
+
+	t.Setenv("MQTT_PASSWORD", "from-env")
+	if _, err := loadConfig([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "MQTT_PASSWORD and MQTT_PASSWORD_FILE are both set") {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	// a flag overrides the secret file
+	t.Setenv("MQTT_PASSWORD", "")
+	config, err = loadConfig([]string{"-config", path, "-mqtt-password", "from-flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.secret("MQTT_PASSWORD", config.MQTT.Password)(); got != "from-flag" {
+		t.Fatalf("password = %q, want the flag to override the secret file", got)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/rindula/msteams-presence-bot-go/atomicfile"
+)
+
+// defaultLicenseDeviceFile keeps the derived device ID, so restarts reuse the
+// same activation even if the hostname or container changes.
+const defaultLicenseDeviceFile = "license.device"
+
+// machineIDFiles are read in order by the machine-id source.
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// errNoGeneratedID is returned by deviceIdentifier when the source needs a
+// random UUID, but generating one was not allowed.
+var errNoGeneratedID = errors.New("the device ID source needs a generated ID")
+
+// licenseDeviceID returns LICENSE_DEVICE_ID if set. Otherwise the ID
+// persisted in LICENSE_DEVICE_FILE is used, or a new one is derived from the
+// source chosen with LICENSE_DEVICE_ID_SOURCE and hashed. With persist the
+// new ID is saved together with its source, so a changed source is noticed;
+// without it nothing is written and no random ID is generated, e.g. for the
+// status command.
+func licenseDeviceID(config LicenseConfig, persist bool) (string, error) {
+	if config.DeviceID != "" {
+		return config.DeviceID, nil
+	}
+	path := config.DeviceFile
+	if path == "" {
+		path = defaultLicenseDeviceFile
+	}
+	source := strings.ToLower(strings.TrimSpace(config.DeviceIDSource))
+	if source == "" {
+		source = "auto"
+	}
+	// files of older versions contain only the ID
+	if deviceID, stored := readLicenseDeviceFile(path); deviceID != "" {
+		if stored == "" || stored == source {
+			return deviceID, nil
+		}
+		if !persist {
+			return "", fmt.Errorf("the device ID in %s was derived from %s, not LICENSE_DEVICE_ID_SOURCE %s; the bot derives a new one on its next start", path, stored, source)
+		}
+		log.Printf("LICENSE_DEVICE_ID_SOURCE changed from %s to %s, deriving a new device ID, which uses another activation\n", stored, source)
+	}
+
+	identifier, err := deviceIdentifier(source, persist)
+	if errors.Is(err, errNoGeneratedID) {
+		return "", fmt.Errorf("no device ID is persisted in %s yet, the bot generates one on its first start", path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot determine a device ID, set LICENSE_DEVICE_ID: %w", err)
+	}
+	deviceID := hashDeviceID(identifier)
+	if persist {
+		if err := atomicfile.WriteFile(path, []byte(deviceID+"\n"+source+"\n")); err != nil {
+			log.Println("Error persisting the license device ID, the next start may use another activation:", err)
+		}
+	}
+	return deviceID, nil
+}
+
+// readLicenseDeviceFile returns the persisted device ID and the source it was
+// derived from, both empty if there is none.
+func readLicenseDeviceFile(path string) (deviceID, source string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", ""
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) == 0 {
+		return "", ""
+	}
+	if len(lines) > 1 {
+		source = lines[1]
+	}
+	return lines[0], source
+}
+
+// deviceIdentifier reads the raw identifier of the installation from source:
+// "machine-id", "generated" for a random UUID, "hostname", or "auto" (the
+// default) for the machine ID if there is one and a random UUID otherwise.
+// Without generate, errNoGeneratedID is returned instead of a random UUID.
+func deviceIdentifier(source string, generate bool) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(source)) {
+	case "", "auto":
+		if machineID, err := readMachineID(); err == nil {
+			return machineID, nil
+		}
+		if !generate {
+			return "", errNoGeneratedID
+		}
+		return generateUUID()
+	case "machine-id":
+		return readMachineID()
+	case "generated":
+		if !generate {
+			return "", errNoGeneratedID
+		}
+		return generateUUID()
+	case "hostname":
+		hostname, err := os.Hostname()
+		if err == nil && strings.TrimSpace(hostname) == "" {
+			err = errors.New("the hostname is empty")
+		}
+		return strings.TrimSpace(hostname), err
+	default:
+		return "", fmt.Errorf("unknown LICENSE_DEVICE_ID_SOURCE %q", source)
+	}
+}
+
+func readMachineID() (string, error) {
+	for _, path := range machineIDFiles {
+		if data, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(data)) != "" {
+			return strings.TrimSpace(string(data)), nil
+		}
+	}
+	return "", errors.New("no machine ID found")
+}
+
+// generateUUID returns a random version 4 UUID.
+func generateUUID() (string, error) {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		return "", err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
+
+// hashDeviceID derives the ID sent to the license server, so the machine ID
+// or hostname never leaves the installation. The prefix keeps the ID apart
+// from hashes of the same identifier in other applications.
+func hashDeviceID(identifier string) string {
+	sum := sha256.Sum256([]byte("msteams-presence-bot-go/license-device:" + identifier))
+	return hex.EncodeToString(sum[:16])
+}
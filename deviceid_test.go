@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useMachineIDFile(t *testing.T, content string) {
+	path := filepath.Join(t.TempDir(), "machine-id")
+	if content != "" {
+		os.WriteFile(path, []byte(content), 0o644)
+	}
+	files := machineIDFiles
+	machineIDFiles = []string{path}
+	t.Cleanup(func() { machineIDFiles = files })
+}
+
+func TestLicenseDeviceIDFromMachineID(t *testing.T) {
+	useMachineIDFile(t, "0123456789abcdef0123456789abcdef\n")
+	deviceFile := filepath.Join(t.TempDir(), "license.device")
+	config := LicenseConfig{DeviceFile: deviceFile}
+
+	deviceID, err := licenseDeviceID(config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deviceID != hashDeviceID("0123456789abcdef0123456789abcdef") || strings.Contains(deviceID, "0123456789abcdef") {
+		t.Fatalf("deviceID = %q", deviceID)
+	}
+	if data, _ := os.ReadFile(deviceFile); string(data) != deviceID+"\nauto\n" {
+		t.Fatalf("persisted device ID = %q", data)
+	}
+
+	// the persisted ID is kept even if the machine ID changes
+	useMachineIDFile(t, "fedcba9876543210fedcba9876543210\n")
+	if again, err := licenseDeviceID(config, true); err != nil || again != deviceID {
+		t.Fatalf("licenseDeviceID() = %q, %v, want %q", again, err, deviceID)
+	}
+}
+
+func TestLicenseDeviceIDGenerated(t *testing.T) {
+	useMachineIDFile(t, "")
+	deviceFile := filepath.Join(t.TempDir(), "license.device")
+	config := LicenseConfig{DeviceFile: deviceFile, DeviceIDSource: "auto"}
+
+	deviceID, err := licenseDeviceID(config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deviceID) != 32 {
+		t.Fatalf("deviceID = %q", deviceID)
+	}
+	if again, err := licenseDeviceID(config, true); err != nil || again != deviceID {
+		t.Fatalf("licenseDeviceID() = %q, %v, want %q", again, err, deviceID)
+	}
+
+	os.Remove(deviceFile)
+	if other, _ := licenseDeviceID(config, true); other == deviceID {
+		t.Fatal("a new installation got the same device ID")
+	}
+}
+
+func TestLicenseDeviceIDPrefersExplicitID(t *testing.T) {
+	deviceFile := filepath.Join(t.TempDir(), "license.device")
+	if deviceID, err := licenseDeviceID(LicenseConfig{DeviceID: "living-room", DeviceFile: deviceFile}, true); err != nil || deviceID != "living-room" {
+		t.Fatalf("licenseDeviceID() = %q, %v", deviceID, err)
+	}
+	if _, err := os.Stat(deviceFile); !os.IsNotExist(err) {
+		t.Fatal("the explicit device ID was persisted")
+	}
+}
+
+func TestDeviceIdentifierSources(t *testing.T) {
+	useMachineIDFile(t, "")
+	if _, err := deviceIdentifier("machine-id", true); err == nil {
+		t.Fatal("missing machine ID was accepted")
+	}
+	hostname, _ := os.Hostname()
+	if identifier, err := deviceIdentifier("hostname", true); err != nil || identifier != hostname {
+		t.Fatalf("deviceIdentifier(hostname) = %q, %v", identifier, err)
+	}
+	first, _ := deviceIdentifier("generated", true)
+	second, _ := deviceIdentifier("generated", true)
+	if len(first) != 36 || first[14] != '4' || first == second {
+		t.Fatalf("generated identifiers = %q, %q", first, second)
+	}
+	if _, err := deviceIdentifier("mac", true); err == nil {
+		t.Fatal("unknown source was accepted")
+	}
+	if _, err := deviceIdentifier("generated", false); !errors.Is(err, errNoGeneratedID) {
+		t.Fatalf("deviceIdentifier(generated) without generating = %v", err)
+	}
+}
+
+func TestLicenseDeviceIDSourceChanged(t *testing.T) {
+	useMachineIDFile(t, "0123456789abcdef0123456789abcdef\n")
+	deviceFile := filepath.Join(t.TempDir(), "license.device")
+	config := LicenseConfig{DeviceFile: deviceFile, DeviceIDSource: "machine-id"}
+	deviceID, err := licenseDeviceID(config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read-only commands report the change without deriving a new ID
+	config.DeviceIDSource = "hostname"
+	if _, err := licenseDeviceID(config, false); err == nil {
+		t.Fatal("licenseDeviceID() ignored the changed source")
+	}
+	hostname, _ := os.Hostname()
+	changed, err := licenseDeviceID(config, true)
+	if err != nil || changed != hashDeviceID(hostname) || changed == deviceID {
+		t.Fatalf("licenseDeviceID() after changing the source = %q, %v", changed, err)
+	}
+	if data, _ := os.ReadFile(deviceFile); string(data) != changed+"\nhostname\n" {
+		t.Fatalf("persisted device ID = %q", data)
+	}
+
+	// files of older versions contain only the ID and are kept
+	os.WriteFile(deviceFile, []byte("legacy-id\n"), 0o600)
+	if legacy, err := licenseDeviceID(config, true); err != nil || legacy != "legacy-id" {
+		t.Fatalf("licenseDeviceID() with an older file = %q, %v", legacy, err)
+	}
+}
+
+func TestLicenseDeviceIDReadOnly(t *testing.T) {
+	useMachineIDFile(t, "")
+	deviceFile := filepath.Join(t.TempDir(), "license.device")
+	if _, err := licenseDeviceID(LicenseConfig{DeviceFile: deviceFile}, false); err == nil {
+		t.Fatal("licenseDeviceID() generated an ID without persisting it")
+	}
+	if deviceID, err := licenseDeviceID(LicenseConfig{DeviceFile: deviceFile, DeviceIDSource: "hostname"}, false); err != nil || deviceID == "" {
+		t.Fatalf("licenseDeviceID() = %q, %v", deviceID, err)
+	}
+	if _, err := os.Stat(deviceFile); !os.IsNotExist(err) {
+		t.Fatal("a read-only lookup persisted the device ID")
+	}
+}
@@ -7,6 +7,9 @@ require github.com/joho/godotenv v1.5.1 // direct
 require (
 	github.com/eclipse/paho.mqtt.golang v1.5.1 // direct
 	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/mochi-mqtt/server/v2 v2.7.9
+	github.com/rs/xid v1.4.0 // indirect
 	golang.org/x/net v0.55.0 // indirect
 	golang.org/x/sync v0.17.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // direct
 )
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var graphBaseURL string = "https://graph.microsoft.com/v1.0"
+
+// graphClient sends the requests to Graph that are not given a client.
+var graphClient *http.Client = http.DefaultClient
+
+type User struct {
+	Id                string `json:"id"`
+	DisplayName       string `json:"displayName,omitempty"`
+	UserPrincipalName string `json:"userPrincipalName,omitempty"`
+}
+
+type graphError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// RetryAfter is set if Graph throttled the request.
+	RetryAfter time.Duration
+}
+
+func (e *graphError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("graph returned HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("graph returned HTTP %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// graphRequest sends a JSON request to the Graph API and decodes the JSON
+// response into out, if out is not nil. path is relative to graphBaseURL
+// unless it is an absolute URL, such as an @odata.nextLink.
+func graphRequest(ctx context.Context, client *http.Client, method, path, accessToken string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("encode graph request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+	endpoint := path
+	if !strings.HasPrefix(path, "https://") && !strings.HasPrefix(path, "http://") {
+		endpoint = strings.TrimRight(graphBaseURL, "/") + path
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return fmt.Errorf("create graph request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("graph request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errorBody struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 32<<10)).Decode(&errorBody)
+		graphErr := &graphError{StatusCode: resp.StatusCode, Code: errorBody.Error.Code, Message: errorBody.Error.Message}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			graphErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return graphErr
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out); err != nil {
+		return fmt.Errorf("decode graph response: %w", err)
+	}
+	return nil
+}
+
+func getMe(ctx context.Context, client *http.Client, accessToken string) (User, error) {
+	var user User
+	if err := graphRequest(ctx, client, http.MethodGet, "/me?$select=id,displayName,userPrincipalName", accessToken, nil, &user); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
@@ -3,19 +3,82 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/rindula/msteams-presence-bot-go/atomicfile"
+	"github.com/rindula/msteams-presence-bot-go/homeassistant"
 )
 
 const defaultLicenseServerURL = "https://license.rindula.de"
 const licenseCheckInterval = 15 * time.Minute
 
+// errLicenseServerUnavailable marks errors that may go away when the request
+// is repeated: the server could not be reached or answered with HTTP 408, 429
+// or 5xx. A license rejected with valid=false is no error.
+var errLicenseServerUnavailable = errors.New("license server unavailable")
+
+// A check makes up to licenseRetry.attempts requests while the server is
+// unavailable, doubling licenseRetry.delay every time unless the server asks
+// for a longer pause with Retry-After, which is capped at licenseMaxRetryAfter.
+// All attempts of a check together are limited to licenseRequestTimeout.
+const (
+	defaultLicenseRetryAttempts = 4
+	defaultLicenseRetryDelay    = 1 * time.Second
+)
+const licenseMaxRetryAfter = 30 * time.Second
+const licenseRequestTimeout = 2 * time.Minute
+
+// licenseRetry is the retry policy set with LICENSE_RETRY_ATTEMPTS and
+// LICENSE_RETRY_DELAY.
+type licenseRetry struct {
+	attempts int
+	delay    time.Duration
+}
+
+// licenseRetryPolicy returns the retry policy of config, the defaults for
+// empty or invalid values.
+func licenseRetryPolicy(config LicenseConfig) licenseRetry {
+	retry := licenseRetry{attempts: defaultLicenseRetryAttempts, delay: defaultLicenseRetryDelay}
+	if attempts, err := strconv.Atoi(config.RetryAttempts); err == nil && attempts >= 1 {
+		retry.attempts = attempts
+	}
+	if delay, err := time.ParseDuration(config.RetryDelay); err == nil && delay > 0 {
+		retry.delay = delay
+	}
+	return retry
+}
+
+// The license server signs the raw body of its responses with Ed25519 and
+// sends the base64 encoded signature in licenseSignatureHeader. Signed
+// responses confirming the license are cached in defaultLicenseCacheFile and
+// accepted for defaultLicenseGracePeriod after they were issued while the
+// server is unreachable.
+const licenseSignatureHeader = "X-License-Signature"
+const defaultLicenseCacheFile = "license.cache"
+const defaultLicenseGracePeriod = 72 * time.Hour
+
+// defaultLicenseWarningDays is how many days before the license expires a
+// warning event is published, once a day.
+const defaultLicenseWarningDays = 14
+
+// licensePublicKey is the base64 encoded Ed25519 key verifying the license
+// server responses, set at build time with
+// -ldflags "-X main.licensePublicKey=...". Without it there is no offline
+// grace period.
+var licensePublicKey string
+
 type licenseValidationRequest struct {
 	LicenseKey string `json:"license_key"`
 	DeviceID   string `json:"device_id"`
@@ -27,80 +90,375 @@ type licenseValidationResponse struct {
 	Customer    string     `json:"customer,omitempty"`
 	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
 	Activations int        `json:"activations,omitempty"`
+	DeviceID    string     `json:"device_id,omitempty"`
+	IssuedAt    *time.Time `json:"issued_at,omitempty"`
+
+	signed signedLicense
 }
 
-func validateLicense(ctx context.Context, client *http.Client, serverURL, licenseKey, deviceID string) (licenseValidationResponse, error) {
+// licenseStatus is published to Topics.License().
+type licenseStatus struct {
+	Valid       bool       `json:"valid"`
+	Customer    string     `json:"customer,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Activations int        `json:"activations"`
+	// Offline is set while the cached license is used because the license
+	// server is unreachable.
+	Offline   bool      `json:"offline"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func (r licenseValidationResponse) status(offline bool, now time.Time) licenseStatus {
+	return licenseStatus{
+		Valid:       r.Valid,
+		Customer:    r.Customer,
+		ExpiresAt:   r.ExpiresAt,
+		Activations: r.Activations,
+		Offline:     offline,
+		CheckedAt:   now.UTC(),
+	}
+}
+
+// licenseEvent is published to Topics.LicenseEvent() when the license is
+// about to expire.
+type licenseEvent struct {
+	Event     string    `json:"event"`
+	Title     string    `json:"title"`
+	Message   string    `json:"message"`
+	ExpiresAt time.Time `json:"expires_at"`
+	DaysLeft  int       `json:"days_left"`
+}
+
+// signedLicense is a license server response with its signature, as cached
+// on disk.
+type signedLicense struct {
+	Response  []byte `json:"response"`
+	Signature []byte `json:"signature"`
+}
+
+// verify checks the signature and decodes the response.
+func (s signedLicense) verify(key ed25519.PublicKey) (licenseValidationResponse, error) {
+	if len(s.Signature) == 0 {
+		return licenseValidationResponse{}, errors.New("the license response is not signed")
+	}
+	if !ed25519.Verify(key, s.Response, s.Signature) {
+		return licenseValidationResponse{}, errors.New("invalid license response signature")
+	}
+	var result licenseValidationResponse
+	if err := json.Unmarshal(s.Response, &result); err != nil {
+		return licenseValidationResponse{}, fmt.Errorf("decode license response: %w", err)
+	}
+	result.signed = s
+	return result, nil
+}
+
+func licenseVerificationKey() (ed25519.PublicKey, error) {
+	if licensePublicKey == "" {
+		return nil, errors.New("this build has no license verification key")
+	}
+	key, err := base64.StdEncoding.DecodeString(licensePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid license verification key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// validateLicense asks the server at serverURL whether licenseKey is valid
+// for deviceID. The request is repeated while the server is unavailable.
+func validateLicense(ctx context.Context, client *http.Client, serverURL, licenseKey, deviceID string, retry licenseRetry) (licenseValidationResponse, error) {
 	licenseKey = strings.TrimSpace(licenseKey)
 	deviceID = strings.TrimSpace(deviceID)
 	if licenseKey == "" {
 		return licenseValidationResponse{}, fmt.Errorf("LICENSE_KEY is not set")
 	}
 	if deviceID == "" {
-		return licenseValidationResponse{}, fmt.Errorf("LICENSE_DEVICE_ID is not set and the hostname is unavailable")
+		return licenseValidationResponse{}, fmt.Errorf("the license device ID is empty")
 	}
 
 	body, err := json.Marshal(licenseValidationRequest{LicenseKey: licenseKey, DeviceID: deviceID})
 	if err != nil {
 		return licenseValidationResponse{}, fmt.Errorf("encode license request: %w", err)
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(serverURL, "/")+"/api/v1/licenses/validate", bytes.NewReader(body))
+	endpoint := strings.TrimRight(serverURL, "/") + "/api/v1/licenses/validate"
+	delay := retry.delay
+	for attempt := 1; ; attempt++ {
+		result, retryAfter, err := requestLicense(ctx, client, endpoint, body)
+		if err == nil || !errors.Is(err, errLicenseServerUnavailable) || attempt >= retry.attempts {
+			return result, err
+		}
+		wait := max(delay, min(retryAfter, licenseMaxRetryAfter))
+		log.Printf("Error validating the license, retrying in %s: %v\n", wait, err)
+		select {
+		case <-ctx.Done():
+			return licenseValidationResponse{}, errors.Join(err, ctx.Err())
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// requestLicense sends a single validation request. For HTTP 429 and 503 it
+// also returns the pause the server asked for.
+func requestLicense(ctx context.Context, client *http.Client, endpoint string, body []byte) (licenseValidationResponse, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
 	if err != nil {
-		return licenseValidationResponse{}, fmt.Errorf("create license request: %w", err)
+		return licenseValidationResponse{}, 0, fmt.Errorf("create license request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return licenseValidationResponse{}, fmt.Errorf("license server request: %w", err)
+		return licenseValidationResponse{}, 0, fmt.Errorf("%w: %w", errLicenseServerUnavailable, err)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return licenseValidationResponse{}, fmt.Errorf("license server returned HTTP %d", resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		var retryAfter time.Duration
+		if value := resp.Header.Get("Retry-After"); value != "" {
+			retryAfter = parseRetryAfter(value, time.Now())
+		}
+		return licenseValidationResponse{}, retryAfter, fmt.Errorf("%w: HTTP %d", errLicenseServerUnavailable, resp.StatusCode)
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500:
+		return licenseValidationResponse{}, 0, fmt.Errorf("%w: HTTP %d", errLicenseServerUnavailable, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return licenseValidationResponse{}, 0, fmt.Errorf("license server returned HTTP %d", resp.StatusCode)
 	}
 
+	body, err = io.ReadAll(io.LimitReader(resp.Body, 32<<10))
+	if err != nil {
+		return licenseValidationResponse{}, 0, fmt.Errorf("%w: read response: %w", errLicenseServerUnavailable, err)
+	}
 	var result licenseValidationResponse
-	if err := json.NewDecoder(io.LimitReader(resp.Body, 32<<10)).Decode(&result); err != nil {
-		return licenseValidationResponse{}, fmt.Errorf("decode license server response: %w", err)
+	if err := json.Unmarshal(body, &result); err != nil {
+		return licenseValidationResponse{}, 0, fmt.Errorf("decode license server response: %w", err)
+	}
+	result.signed.Response = body
+	if signature := resp.Header.Get(licenseSignatureHeader); signature != "" {
+		if result.signed.Signature, err = base64.StdEncoding.DecodeString(signature); err != nil {
+			return licenseValidationResponse{}, 0, fmt.Errorf("decode license server signature: %w", err)
+		}
+	}
+	return result, 0, nil
+}
+
+// licenseServerURL returns LICENSE_SERVER_URL, e.g. an on-premises mirror, or
+// the public license server.
+func licenseServerURL(config LicenseConfig) string {
+	if config.ServerURL != "" {
+		return config.ServerURL
+	}
+	return defaultLicenseServerURL
+}
+
+// saveLicenseCache stores a verified response confirming the license.
+func saveLicenseCache(path string, signed signedLicense) error {
+	data, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data)
+}
+
+// cachedLicense returns the license cached in path if its signature is valid,
+// it confirms the license for deviceID and it was issued at most grace before
+// now.
+func cachedLicense(path string, key ed25519.PublicKey, deviceID string, grace time.Duration, now time.Time) (licenseValidationResponse, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return licenseValidationResponse{}, fmt.Errorf("read license cache: %w", err)
+	}
+	var signed signedLicense
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return licenseValidationResponse{}, fmt.Errorf("decode license cache: %w", err)
+	}
+	result, err := signed.verify(key)
+	if err != nil {
+		return licenseValidationResponse{}, err
+	}
+	switch {
+	case !result.Valid:
+		return licenseValidationResponse{}, errors.New("the cached license is not valid")
+	case result.DeviceID != strings.TrimSpace(deviceID):
+		return licenseValidationResponse{}, errors.New("the cached license belongs to another device")
+	case result.IssuedAt == nil:
+		return licenseValidationResponse{}, errors.New("the cached license has no issue date")
+	case now.Sub(*result.IssuedAt) > grace:
+		return licenseValidationResponse{}, fmt.Errorf("the grace period of the cached license ended at %s", result.IssuedAt.Add(grace).Format(time.RFC3339))
+	case result.ExpiresAt != nil && now.After(*result.ExpiresAt):
+		return licenseValidationResponse{}, errors.New("the cached license has expired")
 	}
 	return result, nil
 }
 
-func currentLicenseDeviceID() (string, error) {
-	if deviceID := strings.TrimSpace(os.Getenv("LICENSE_DEVICE_ID")); deviceID != "" {
-		return deviceID, nil
+// licenseCache returns the cache file and the grace period set with
+// LICENSE_CACHE_FILE and LICENSE_GRACE_PERIOD.
+func licenseCache(config LicenseConfig) (string, time.Duration) {
+	path := config.CacheFile
+	if path == "" {
+		path = defaultLicenseCacheFile
+	}
+	grace := defaultLicenseGracePeriod
+	if value := config.GracePeriod; value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			grace = d
+		}
+	}
+	return path, grace
+}
+
+// warnWithoutLicenseGrace logs a warning if a grace period is configured but
+// cached licenses cannot be verified, because this build has no valid public
+// key.
+func warnWithoutLicenseGrace(config LicenseConfig) {
+	_, grace := licenseCache(config)
+	if grace == 0 {
+		return
 	}
-	if hostname, err := os.Hostname(); err == nil && strings.TrimSpace(hostname) != "" {
-		return strings.TrimSpace(hostname), nil
+	if _, err := licenseVerificationKey(); err != nil {
+		log.Printf("Warning: LICENSE_GRACE_PERIOD is %s, but %v; the bot only starts while the license server is reachable\n", grace, err)
 	}
-	return "", fmt.Errorf("cannot determine a device ID; set LICENSE_DEVICE_ID")
 }
 
-func authenticateLicense() error {
-	deviceID, err := currentLicenseDeviceID()
+// authenticateLicense validates the license of config and returns its
+// status.
+func authenticateLicense(ctx context.Context, config *Config) (licenseStatus, error) {
+	deviceID, err := licenseDeviceID(config.License, true)
 	if err != nil {
-		return err
+		return licenseStatus{}, err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, licenseRequestTimeout)
 	defer cancel()
-	result, err := validateLicense(ctx, &http.Client{Timeout: 15 * time.Second}, defaultLicenseServerURL, os.Getenv("LICENSE_KEY"), deviceID)
+	cacheFile, grace := licenseCache(config.License)
+	key, keyErr := licenseVerificationKey()
+	licenseKey := config.secret("LICENSE_KEY", config.License.Key)
+	result, err := validateLicense(ctx, &http.Client{Timeout: 15 * time.Second}, licenseServerURL(config.License), licenseKey(), deviceID, licenseRetryPolicy(config.License))
 	if err != nil {
-		return err
+		// while the server is unreachable, a recently confirmed license is
+		// still accepted
+		if !errors.Is(err, errLicenseServerUnavailable) || keyErr != nil || grace == 0 {
+			return licenseStatus{}, err
+		}
+		cached, cacheErr := cachedLicense(cacheFile, key, deviceID, grace, time.Now())
+		if cacheErr != nil {
+			return licenseStatus{}, fmt.Errorf("%w (no offline grace: %v)", err, cacheErr)
+		}
+		log.Printf("License server unreachable, using the license confirmed at %s until %s: %v\n", cached.IssuedAt.Format(time.RFC3339), cached.IssuedAt.Add(grace).Format(time.RFC3339), err)
+		return cached.status(true, time.Now()), nil
 	}
 	if !result.Valid {
+		os.Remove(cacheFile)
 		if result.Reason == "" {
 			result.Reason = "rejected"
 		}
-		return fmt.Errorf("license rejected: %s", result.Reason)
+		return licenseStatus{}, fmt.Errorf("license rejected: %s", result.Reason)
+	}
+	if keyErr == nil && grace > 0 {
+		if _, err := result.signed.verify(key); err != nil {
+			log.Println("Not caching the license for offline use:", err)
+		} else if err := saveLicenseCache(cacheFile, result.signed); err != nil {
+			log.Println("Error caching the license:", err)
+		}
+	}
+	return result.status(false, time.Now()), nil
+}
+
+// licenseMonitor publishes the license status and warns before the license
+// expires.
+type licenseMonitor struct {
+	connection *mqttConnection
+	topics     Topics
+	config     *Config
+	// warning is how long before the expiry the warning event is published,
+	// 0 disables it.
+	warning time.Duration
+	now     func() time.Time
+
+	mu         sync.Mutex
+	lastWarned time.Time
+}
+
+func newLicenseMonitor(connection *mqttConnection, topics Topics, config *Config) *licenseMonitor {
+	days := defaultLicenseWarningDays
+	if value := config.License.WarningDays; value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			days = parsed
+		}
+	}
+	return &licenseMonitor{connection: connection, topics: topics, config: config, warning: time.Duration(days) * 24 * time.Hour, now: time.Now}
+}
+
+// update publishes status and the warning event if the license expires
+// within the warning period and no warning was sent during the last day.
+func (m *licenseMonitor) update(status licenseStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statusJson, _ := json.Marshal(status)
+	m.connection.Publish(m.topics.License(), 1, true, statusJson)
+
+	now := m.now()
+	if m.warning == 0 || status.ExpiresAt == nil || status.ExpiresAt.Sub(now) > m.warning || now.Sub(m.lastWarned) < 24*time.Hour {
+		return
 	}
-	return nil
+	m.lastWarned = now
+	daysLeft := max(int(status.ExpiresAt.Sub(now).Hours()/24), 0)
+	eventJson, _ := json.Marshal(licenseEvent{
+		Event:     "license_expiring",
+		Title:     "Teams Presence Bot license expires soon",
+		Message:   fmt.Sprintf("The license of the Teams presence bot expires on %s (%d days left).", status.ExpiresAt.Format("2006-01-02"), daysLeft),
+		ExpiresAt: status.ExpiresAt.UTC(),
+		DaysLeft:  daysLeft,
+	})
+	m.connection.Publish(m.topics.LicenseEvent(), 1, false, eventJson)
 }
 
-func periodicLicenseCheck() {
+// Run publishes status and validates the license again every
+// licenseCheckInterval until ctx is done. It returns an error when the
+// license is rejected, so the caller can shut the bot down.
+func (m *licenseMonitor) Run(ctx context.Context, status licenseStatus) error {
+	m.update(status)
 	ticker := time.NewTicker(licenseCheckInterval)
 	defer ticker.Stop()
-	for range ticker.C {
-		if err := authenticateLicense(); err != nil {
-			log.Fatalln("Periodic license validation failed:", err)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
 		}
+		status, err := authenticateLicense(ctx, m.config)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("periodic license validation failed: %w", err)
+		}
+		m.update(status)
+	}
+}
+
+// licenseEntities returns the diagnostic entities showing the license status.
+func licenseEntities(topics Topics) []discoveryEntity {
+	return []discoveryEntity{
+		{component: "binary_sensor", objectID: "license_valid", config: HomeassistantDevice{
+			Name:                "Teams License Valid",
+			StateTopic:          topics.License(),
+			ValueTemplate:       "{{ 'ON' if value_json.valid else 'OFF' }}",
+			JsonAttributesTopic: topics.License(),
+			Icon:                "mdi:license",
+			EntityCategory:      homeassistant.EntityCategoryDiagnostic,
+		}},
+		{component: "sensor", objectID: "license_expires", config: HomeassistantDevice{
+			Name:           "Teams License Expires",
+			StateTopic:     topics.License(),
+			ValueTemplate:  "{{ value_json.expires_at if value_json.expires_at else 'None' }}",
+			DeviceClass:    homeassistant.DeviceClassTimestamp,
+			EntityCategory: homeassistant.EntityCategoryDiagnostic,
+		}},
+		{component: "sensor", objectID: "license_activations", config: HomeassistantDevice{
+			Name:           "Teams License Activations",
+			StateTopic:     topics.License(),
+			ValueTemplate:  "{{ value_json.activations }}",
+			Icon:           "mdi:counter",
+			EntityCategory: homeassistant.EntityCategoryDiagnostic,
+		}},
 	}
 }
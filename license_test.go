@@ -1,11 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 func TestValidateLicense(t *testing.T) {
@@ -28,7 +40,7 @@ func TestValidateLicense(t *testing.T) {
 	}))
 	defer server.Close()
 
-	result, err := validateLicense(context.Background(), server.Client(), server.URL, " TEST-KEY ", " device-1 ")
+	result, err := validateLicense(context.Background(), server.Client(), server.URL, " TEST-KEY ", " device-1 ", fastLicenseRetry)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -43,7 +55,7 @@ func TestValidateLicenseRejectsInvalidLicense(t *testing.T) {
 	}))
 	defer server.Close()
 
-	result, err := validateLicense(context.Background(), server.Client(), server.URL, "KEY", "device")
+	result, err := validateLicense(context.Background(), server.Client(), server.URL, "KEY", "device", fastLicenseRetry)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,10 +66,314 @@ func TestValidateLicenseRejectsInvalidLicense(t *testing.T) {
 
 func TestValidateLicenseRequiresCredentials(t *testing.T) {
 	client := &http.Client{}
-	if _, err := validateLicense(context.Background(), client, "http://localhost", "", "device"); err == nil {
+	if _, err := validateLicense(context.Background(), client, "http://localhost", "", "device", fastLicenseRetry); err == nil {
 		t.Fatal("empty license key was accepted")
 	}
-	if _, err := validateLicense(context.Background(), client, "http://localhost", "key", ""); err == nil {
+	if _, err := validateLicense(context.Background(), client, "http://localhost", "key", "", fastLicenseRetry); err == nil {
 		t.Fatal("empty device ID was accepted")
 	}
 }
+
+func TestLicenseDeviceIDFromSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "device_id")
+	os.WriteFile(path, []byte("living-room\n"), 0o600)
+	clearConfigEnv(t)
+	t.Setenv("LICENSE_DEVICE_ID_FILE", path)
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deviceID, err := licenseDeviceID(config.License, true); err != nil || deviceID != "living-room" {
+		t.Fatalf("licenseDeviceID() = %q, %v", deviceID, err)
+	}
+}
+
+// signedLicenseServer answers every validation with response, signed with
+// key.
+func signedLicenseServer(t *testing.T, key ed25519.PrivateKey, response licenseValidationResponse) *httptest.Server {
+	body, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(licenseSignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(key, body)))
+		w.Write(body)
+	}))
+}
+
+func TestCachedLicense(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuedAt := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	server := signedLicenseServer(t, private, licenseValidationResponse{Valid: true, DeviceID: "device-1", IssuedAt: &issuedAt})
+	defer server.Close()
+
+	result, err := validateLicense(context.Background(), server.Client(), server.URL, "KEY", "device-1", fastLicenseRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := result.signed.verify(public); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "license.cache")
+	if err := saveLicenseCache(path, result.signed); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("cache directory contains %d files, want only the cache", len(entries))
+	}
+
+	grace := 72 * time.Hour
+	if _, err := cachedLicense(path, public, "device-1", grace, issuedAt.Add(grace-time.Minute)); err != nil {
+		t.Fatalf("license within the grace period: %v", err)
+	}
+	if _, err := cachedLicense(path, public, "device-1", grace, issuedAt.Add(grace+time.Minute)); err == nil {
+		t.Fatal("license after the grace period was accepted")
+	}
+	if _, err := cachedLicense(path, public, "device-2", grace, issuedAt); err == nil {
+		t.Fatal("license of another device was accepted")
+	}
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := cachedLicense(path, otherKey, "device-1", grace, issuedAt); err == nil {
+		t.Fatal("license signed with another key was accepted")
+	}
+
+	// extending the issue date breaks the signature
+	tampered := result.signed
+	tampered.Response = bytes.Replace(tampered.Response, []byte("2026-10-01"), []byte("2026-10-09"), 1)
+	saveLicenseCache(path, tampered)
+	if _, err := cachedLicense(path, public, "device-1", grace, issuedAt.Add(grace+time.Hour)); err == nil {
+		t.Fatal("tampered license was accepted")
+	}
+}
+
+func TestCachedLicenseRejectsInvalidLicense(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuedAt := time.Now()
+	server := signedLicenseServer(t, private, licenseValidationResponse{Reason: "revoked", DeviceID: "device-1", IssuedAt: &issuedAt})
+	defer server.Close()
+
+	result, err := validateLicense(context.Background(), server.Client(), server.URL, "KEY", "device-1", fastLicenseRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "license.cache")
+	saveLicenseCache(path, result.signed)
+	if _, err := cachedLicense(path, public, "device-1", time.Hour, issuedAt); err == nil {
+		t.Fatal("rejected license was accepted offline")
+	}
+}
+
+func TestUnsignedLicenseIsNotVerified(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(licenseValidationResponse{Valid: true})
+	}))
+	defer server.Close()
+
+	result, err := validateLicense(context.Background(), server.Client(), server.URL, "KEY", "device-1", fastLicenseRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := result.signed.verify(public); err == nil {
+		t.Fatal("unsigned response was verified")
+	}
+}
+
+func TestLicenseMonitor(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.stop()
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", b.address))
+	opts.SetClientID("test-bot")
+	connection := newMQTTConnection(opts, testTopics, nil)
+	connection.Connect()
+	defer connection.Close()
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	monitor := &licenseMonitor{connection: connection, topics: testTopics, warning: 14 * 24 * time.Hour, now: func() time.Time { return now }}
+	expiresAt := now.Add(30 * 24 * time.Hour)
+	monitor.update(licenseStatus{Valid: true, Customer: "Test", ExpiresAt: &expiresAt, Activations: 2, CheckedAt: now})
+	b.waitFor(testTopics.License(), `{"valid":true,"customer":"Test","expires_at":"2026-11-17T12:00:00Z","activations":2,"offline":false,"checked_at":"2026-10-18T12:00:00Z"}`)
+
+	now = now.Add(20 * 24 * time.Hour)
+	monitor.update(licenseStatus{Valid: true, ExpiresAt: &expiresAt, Activations: 2, CheckedAt: now})
+	b.waitFor(testTopics.LicenseEvent(), `{"event":"license_expiring","title":"Teams Presence Bot license expires soon","message":"The license of the Teams presence bot expires on 2026-11-17 (10 days left).","expires_at":"2026-11-17T12:00:00Z","days_left":10}`)
+
+	// the warning is repeated once a day
+	now = now.Add(time.Hour)
+	monitor.update(licenseStatus{Valid: true, ExpiresAt: &expiresAt, Activations: 2, CheckedAt: now})
+	now = now.Add(24 * time.Hour)
+	monitor.update(licenseStatus{Valid: true, ExpiresAt: &expiresAt, Activations: 2, CheckedAt: now})
+	b.waitFor(testTopics.LicenseEvent(), `{"event":"license_expiring","title":"Teams Presence Bot license expires soon","message":"The license of the Teams presence bot expires on 2026-11-17 (8 days left).","expires_at":"2026-11-17T12:00:00Z","days_left":8}`)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if events := b.messages[testTopics.LicenseEvent()]; len(events) != 2 {
+		t.Fatalf("events = %v", events)
+	}
+}
+
+// fastLicenseRetry retries license requests with a short delay.
+var fastLicenseRetry = licenseRetry{attempts: defaultLicenseRetryAttempts, delay: time.Millisecond}
+
+func TestValidateLicenseRetriesUnavailableServer(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			json.NewEncoder(w).Encode(licenseValidationResponse{Valid: true})
+		}
+	}))
+	defer server.Close()
+
+	result, err := validateLicense(context.Background(), server.Client(), server.URL, "KEY", "device", fastLicenseRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || attempts != 3 {
+		t.Fatalf("result = %+v after %d attempts", result, attempts)
+	}
+}
+
+func TestValidateLicenseGivesUpOnUnreachableServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	serverURL := server.URL
+	server.Close()
+
+	_, err := validateLicense(context.Background(), &http.Client{}, serverURL, "KEY", "device", fastLicenseRetry)
+	if !errors.Is(err, errLicenseServerUnavailable) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestLicenseRetryPolicy(t *testing.T) {
+	if retry := licenseRetryPolicy(LicenseConfig{}); retry != (licenseRetry{attempts: 4, delay: time.Second}) {
+		t.Fatalf("default policy = %+v", retry)
+	}
+	if retry := licenseRetryPolicy(LicenseConfig{RetryAttempts: "1", RetryDelay: "5s"}); retry != (licenseRetry{attempts: 1, delay: 5 * time.Second}) {
+		t.Fatalf("policy = %+v", retry)
+	}
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	if _, err := validateLicense(context.Background(), server.Client(), server.URL, "KEY", "device", licenseRetry{attempts: 2, delay: time.Millisecond}); !errors.Is(err, errLicenseServerUnavailable) || attempts != 2 {
+		t.Fatalf("err = %v after %d attempts", err, attempts)
+	}
+}
+
+func TestValidateLicenseDoesNotRetryPermanentErrors(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr bool
+	}{
+		{name: "rejected", handler: func(w http.ResponseWriter, _ *http.Request) {
+			json.NewEncoder(w).Encode(licenseValidationResponse{Reason: "device limit reached"})
+		}},
+		{name: "bad request", wantErr: true, handler: func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}},
+		{name: "invalid body", wantErr: true, handler: func(w http.ResponseWriter, _ *http.Request) {
+			w.Write([]byte("<html>"))
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				test.handler(w, r)
+			}))
+			defer server.Close()
+
+			result, err := validateLicense(context.Background(), server.Client(), server.URL, "KEY", "device", fastLicenseRetry)
+			if (err != nil) != test.wantErr || errors.Is(err, errLicenseServerUnavailable) {
+				t.Fatalf("err = %v", err)
+			}
+			if result.Valid || attempts != 1 {
+				t.Fatalf("result = %+v after %d attempts", result, attempts)
+			}
+		})
+	}
+}
+
+func TestValidateLicenseStopsRetryingWhenCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := validateLicense(ctx, server.Client(), server.URL, "KEY", "device", licenseRetry{attempts: defaultLicenseRetryAttempts, delay: time.Hour}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestAuthenticateLicense(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := licensePublicKey
+	licensePublicKey = base64.StdEncoding.EncodeToString(public)
+	defer func() { licensePublicKey = key }()
+	cacheFile := filepath.Join(t.TempDir(), "license.cache")
+	config := &Config{License: LicenseConfig{Key: "KEY", DeviceID: "device-1", CacheFile: cacheFile, RetryDelay: "1ms"}}
+
+	issuedAt := time.Now().UTC().Truncate(time.Second)
+	expiresAt := issuedAt.Add(365 * 24 * time.Hour)
+	online := signedLicenseServer(t, private, licenseValidationResponse{Valid: true, Customer: "Test", ExpiresAt: &expiresAt, Activations: 1, DeviceID: "device-1", IssuedAt: &issuedAt})
+	defer online.Close()
+	config.License.ServerURL = online.URL
+	status, err := authenticateLicense(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Valid || status.Offline || status.Customer != "Test" || status.Activations != 1 {
+		t.Fatalf("online status = %+v", status)
+	}
+	if _, err := os.Stat(cacheFile); err != nil {
+		t.Fatal("the signed license was not cached:", err)
+	}
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	config.License.ServerURL = unavailable.URL
+	if status, err := authenticateLicense(context.Background(), config); err != nil || !status.Valid || !status.Offline {
+		t.Fatalf("offline status = %+v, %v", status, err)
+	}
+	config.License.GracePeriod = "0"
+	if _, err := authenticateLicense(context.Background(), config); err == nil {
+		t.Fatal("cached license was used without grace period")
+	}
+	config.License.GracePeriod = ""
+
+	rejecting := signedLicenseServer(t, private, licenseValidationResponse{Reason: "revoked", DeviceID: "device-1", IssuedAt: &issuedAt})
+	defer rejecting.Close()
+	config.License.ServerURL = rejecting.URL
+	if _, err := authenticateLicense(context.Background(), config); err == nil {
+		t.Fatal("rejected license was accepted")
+	}
+	if _, err := os.Stat(cacheFile); !os.IsNotExist(err) {
+		t.Fatal("the cached license was kept after the rejection")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rindula/msteams-presence-bot-go/homeassistant"
+	"github.com/rindula/msteams-presence-bot-go/token"
+)
+
+// loginStatus is published to Topics.Login() so the device code prompt is
+// visible in Home Assistant when the bot runs headless.
+type loginStatus struct {
+	Pending         bool      `json:"pending"`
+	VerificationURI string    `json:"verification_uri,omitempty"`
+	UserCode        string    `json:"user_code,omitempty"`
+	ExpiresAt       time.Time `json:"expires_at,omitzero"`
+	// Remaining is the number of seconds until the code expires.
+	Remaining int `json:"remaining"`
+}
+
+// loginEvent is published to Topics.LoginEvent() when a login starts and
+// when it completes, expires or fails, e.g. to create a persistent
+// notification in an automation.
+type loginEvent struct {
+	Event           string    `json:"event"`
+	Title           string    `json:"title"`
+	Message         string    `json:"message"`
+	VerificationURI string    `json:"verification_uri,omitempty"`
+	UserCode        string    `json:"user_code,omitempty"`
+	ExpiresAt       time.Time `json:"expires_at,omitzero"`
+}
+
+// loginMonitor tracks the device code login of the token package.
+type loginMonitor struct {
+	connection *mqttConnection
+	topics     Topics
+	now        func() time.Time
+
+	mu    sync.Mutex
+	state token.LoginState
+}
+
+func newLoginMonitor(connection *mqttConnection, topics Topics) *loginMonitor {
+	m := &loginMonitor{connection: connection, topics: topics, now: time.Now}
+	token.OnLoginState(m.update)
+	return m
+}
+
+func (m *loginMonitor) update(state token.LoginState) {
+	m.mu.Lock()
+	wasPending := m.state.Pending
+	m.state = state
+	m.mu.Unlock()
+
+	var event loginEvent
+	switch {
+	case state.Pending:
+		event = loginEvent{
+			Event:           "login_required",
+			Title:           "Teams Presence Bot login required",
+			Message:         fmt.Sprintf("Open %s and enter the code %s to sign the Teams presence bot in again.", state.VerificationURI, state.UserCode),
+			VerificationURI: state.VerificationURI,
+			UserCode:        state.UserCode,
+			ExpiresAt:       state.ExpiresAt.UTC(),
+		}
+	case !wasPending:
+		return
+	case state.Outcome == token.LoginSucceeded:
+		event = loginEvent{Event: "login_completed", Title: "Teams Presence Bot", Message: "The Teams presence bot is signed in again."}
+	case state.Outcome == token.LoginExpired:
+		event = loginEvent{Event: "login_expired", Title: "Teams Presence Bot login expired", Message: "The login code expired before it was entered, the Teams presence bot is still signed out."}
+	default:
+		event = loginEvent{Event: "login_failed", Title: "Teams Presence Bot login failed", Message: "The login did not complete, the Teams presence bot is still signed out."}
+	}
+	eventJson, _ := json.Marshal(event)
+	m.connection.Publish(m.topics.LoginEvent(), 1, false, eventJson)
+}
+
+func (m *loginMonitor) Status() loginStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.state.Pending {
+		return loginStatus{}
+	}
+	return loginStatus{
+		Pending:         true,
+		VerificationURI: m.state.VerificationURI,
+		UserCode:        m.state.UserCode,
+		ExpiresAt:       m.state.ExpiresAt.UTC(),
+		Remaining:       max(int(m.state.ExpiresAt.Sub(m.now()).Seconds()), 0),
+	}
+}
+
+// Run publishes the login status every second while a login is pending and
+// otherwise when the heartbeat is due, until ctx is done. It runs apart from
+// the presence loop, which waits for the token during the login.
+func (m *loginMonitor) Run(ctx context.Context, heartbeat time.Duration) {
+	var last loginStatus
+	var lastPublished time.Time
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		status := m.Status()
+		if status == last && time.Since(lastPublished) < heartbeat {
+			continue
+		}
+		statusJson, _ := json.Marshal(status)
+		m.connection.Publish(m.topics.Login(), 0, true, statusJson)
+		last = status
+		lastPublished = time.Now()
+	}
+}
+
+// loginEntities returns the entities showing a pending device code login.
+func loginEntities(topics Topics) []discoveryEntity {
+	return []discoveryEntity{
+		{component: "binary_sensor", objectID: "login_required", config: HomeassistantDevice{
+			Name:           "Teams Login Required",
+			StateTopic:     topics.Login(),
+			ValueTemplate:  "{{ 'ON' if value_json.pending else 'OFF' }}",
+			Icon:           "mdi:account-key",
+			EntityCategory: homeassistant.EntityCategoryDiagnostic,
+		}},
+		{component: "sensor", objectID: "login_code", config: HomeassistantDevice{
+			Name:           "Teams Login Code",
+			StateTopic:     topics.Login(),
+			ValueTemplate:  "{{ value_json.user_code if value_json.pending else 'None' }}",
+			Icon:           "mdi:form-textbox-password",
+			EntityCategory: homeassistant.EntityCategoryDiagnostic,
+		}},
+		{component: "sensor", objectID: "login_url", config: HomeassistantDevice{
+			Name:           "Teams Login URL",
+			StateTopic:     topics.Login(),
+			ValueTemplate:  "{{ value_json.verification_uri if value_json.pending else 'None' }}",
+			Icon:           "mdi:web",
+			EntityCategory: homeassistant.EntityCategoryDiagnostic,
+		}},
+		{component: "sensor", objectID: "login_expires", config: HomeassistantDevice{
+			Name:           "Teams Login Expires",
+			StateTopic:     topics.Login(),
+			ValueTemplate:  "{{ value_json.expires_at if value_json.pending else 'None' }}",
+			DeviceClass:    homeassistant.DeviceClassTimestamp,
+			EntityCategory: homeassistant.EntityCategoryDiagnostic,
+		}},
+		{component: "sensor", objectID: "login_countdown", config: HomeassistantDevice{
+			Name:              "Teams Login Countdown",
+			StateTopic:        topics.Login(),
+			ValueTemplate:     "{{ value_json.remaining }}",
+			DeviceClass:       homeassistant.DeviceClassDuration,
+			UnitOfMeasurement: "s",
+			Icon:              "mdi:timer-sand",
+			EntityCategory:    homeassistant.EntityCategoryDiagnostic,
+		}},
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rindula/msteams-presence-bot-go/token"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestLoginMonitor(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.stop()
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", b.address))
+	opts.SetClientID("test-bot")
+	connection := newMQTTConnection(opts, testTopics, nil)
+	connection.Connect()
+	defer connection.Close()
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	monitor := &loginMonitor{connection: connection, topics: testTopics, now: func() time.Time { return now }}
+	if status := monitor.Status(); status != (loginStatus{}) {
+		t.Fatalf("status = %+v", status)
+	}
+
+	monitor.update(token.LoginState{Pending: true, VerificationURI: "https://microsoft.com/devicelogin", UserCode: "ABCD1234", ExpiresAt: now.Add(15 * time.Minute)})
+	b.waitFor(testTopics.LoginEvent(), `{"event":"login_required","title":"Teams Presence Bot login required","message":"Open https://microsoft.com/devicelogin and enter the code ABCD1234 to sign the Teams presence bot in again.","verification_uri":"https://microsoft.com/devicelogin","user_code":"ABCD1234","expires_at":"2026-10-18T12:15:00Z"}`)
+
+	now = now.Add(time.Minute)
+	statusJson, _ := json.Marshal(monitor.Status())
+	if string(statusJson) != `{"pending":true,"verification_uri":"https://microsoft.com/devicelogin","user_code":"ABCD1234","expires_at":"2026-10-18T12:15:00Z","remaining":840}` {
+		t.Fatalf("status = %s", statusJson)
+	}
+
+	monitor.update(token.LoginState{Outcome: token.LoginSucceeded})
+	b.waitFor(testTopics.LoginEvent(), `{"event":"login_completed","title":"Teams Presence Bot","message":"The Teams presence bot is signed in again."}`)
+	if status := monitor.Status(); status.Pending {
+		t.Fatalf("status = %+v", status)
+	}
+}
+
+func TestLoginMonitorExpired(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.stop()
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", b.address))
+	opts.SetClientID("test-bot")
+	connection := newMQTTConnection(opts, testTopics, nil)
+	connection.Connect()
+	defer connection.Close()
+
+	monitor := &loginMonitor{connection: connection, topics: testTopics, now: time.Now}
+	monitor.update(token.LoginState{Pending: true, VerificationURI: "https://microsoft.com/devicelogin", UserCode: "ABCD1234", ExpiresAt: time.Now().Add(15 * time.Minute)})
+	monitor.update(token.LoginState{Outcome: token.LoginExpired})
+	b.waitFor(testTopics.LoginEvent(), `{"event":"login_expired","title":"Teams Presence Bot login expired","message":"The login code expired before it was entered, the Teams presence bot is still signed out."}`)
+	b.mu.Lock()
+	for _, message := range b.messages[testTopics.LoginEvent()] {
+		if strings.Contains(message, "login_completed") {
+			t.Errorf("expired login was published as completed: %s", message)
+		}
+	}
+	b.mu.Unlock()
+	if status := monitor.Status(); status.Pending {
+		t.Fatalf("status = %+v", status)
+	}
+}
+
+func TestPresenceUnavailableWhileLoginPending(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.stop()
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", b.address))
+	opts.SetClientID("test-bot")
+	connection := newMQTTConnection(opts, testTopics, func(client mqtt.Client) {
+		sendDeviceDescriptionMqtt(client, testTopics, newDevice(testTopics, "Jane"))
+	})
+	connection.Connect()
+	defer connection.Close()
+
+	configs := map[string]HomeassistantDevice{}
+	for _, objectID := range []string{"availability", "login_code"} {
+		component := "sensor"
+		topic := testTopics.Discovery(component, objectID)
+		waitUntil(t, func() bool {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			return len(b.messages[topic]) > 0
+		}, "no discovery config on "+topic)
+		b.mu.Lock()
+		var config HomeassistantDevice
+		json.Unmarshal([]byte(b.messages[topic][0]), &config)
+		b.mu.Unlock()
+		configs[objectID] = config
+	}
+	if availability := configs["availability"].Availability; len(availability) != 2 || availability[1].Topic != testTopics.Login() || availability[1].ValueTemplate == "" {
+		t.Fatalf("presence availability = %+v", availability)
+	}
+	if availability := configs["login_code"].Availability; len(availability) != 1 {
+		t.Fatalf("login availability = %+v", availability)
+	}
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/rindula/msteams-presence-bot-go/homeassistant"
@@ -29,12 +34,20 @@ type Device struct {
 	Identifiers  string `json:"identifiers"`
 }
 
+type Availability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available,omitempty"`
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"`
+	ValueTemplate       string `json:"value_template,omitempty"`
+}
+
 type HomeassistantDevice struct {
 	Name                   string                       `json:"name,omitempty"`
+	Availability           []Availability               `json:"availability,omitempty"`
 	AvailabilityMode       string                       `json:"availability_mode,omitempty"`
 	Device                 Device                       `json:"device,omitempty"`
 	UniqueId               string                       `json:"unique_id,omitempty"`
-	StateTopic             string                       `json:"state_topic"`
+	StateTopic             string                       `json:"state_topic,omitempty"`
 	ValueTemplate          string                       `json:"value_template,omitempty"`
 	ExpireAfter            int                          `json:"expire_after,omitempty"`
 	Icon                   string                       `json:"icon,omitempty"`
@@ -48,6 +61,10 @@ type HomeassistantDevice struct {
 	LatestVersionTopic     string                       `json:"latest_version_topic,omitempty"`
 	LatestVersionTemplate  string                       `json:"latest_version_template,omitempty"`
 	ReleaseUrl             string                       `json:"release_url,omitempty"`
+	CommandTopic           string                       `json:"command_topic,omitempty"`
+	Options                []string                     `json:"options,omitempty"`
+	Max                    int                          `json:"max,omitempty"`
+	UnitOfMeasurement      string                       `json:"unit_of_measurement,omitempty"`
 }
 
 type Version struct {
@@ -56,62 +73,133 @@ type Version struct {
 }
 
 var expiration int64 = 120
-var device = Device{
-	Manufacturer: "Rindula",
-	Model:        "Go",
-	Name:         "Teams Status",
-	SwVersion:    version,
-	Identifiers:  "Teams Status",
-}
+
+// shutdownTimeout bounds how long the bot takes to stop after SIGINT or
+// SIGTERM, even if a request or the broker does not respond.
+const shutdownTimeout = 10 * time.Second
 
 func main() {
-	// create .env file, if not exists
-	if _, err := os.Stat(".env"); os.IsNotExist(err) {
-		file, err := os.Create(".env")
-		if err != nil {
-			log.Fatalln("Error creating .env file", err)
-		}
-		defer file.Close()
-		// check if the environment variables are set and exit if not
-		if os.Getenv("CLIENT_ID") == "" || os.Getenv("AUTH_TENANT") == "" || os.Getenv("GRAPH_USER_SCOPES") == "" || os.Getenv("MQTT_USER") == "" || os.Getenv("MQTT_PASSWORD") == "" || os.Getenv("MQTT_HOST") == "" {
-			file.WriteString("CLIENT_ID=\n")
-			file.WriteString("AUTH_TENANT=\n")
-			file.WriteString("GRAPH_USER_SCOPES='user.read offline_access'\n")
-			file.WriteString("MQTT_USER=\n")
-			file.WriteString("MQTT_PASSWORD=\n")
-			file.WriteString("MQTT_HOST=\n")
-			file.WriteString("MQTT_PORT=1883\n")
-			file.WriteString("LICENSE_KEY=\n")
-			file.WriteString("LICENSE_DEVICE_ID=\n")
-			log.Fatalln("Please fill in the .env file")
-		} else {
-			// fill in the .env file
-			envs := os.Environ()
-			envMap := make(map[string]string, len(envs))
-			for _, s := range envs {
-				pair := strings.SplitN(s, "=", 2)
-				envMap[pair[0]] = pair[1]
-			}
-			envString, _ := godotenv.Marshal(envMap)
-			file.WriteString(envString)
-		}
+	// an existing .env file is still read, but never written
+	if err := godotenv.Load(".env"); err != nil && !os.IsNotExist(err) {
+		log.Println("Error loading .env file:", err)
 	}
+	args := os.Args[1:]
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q, use run, login, logout, status or doctor\n", name)
+		os.Exit(2)
+	}
+	command(args)
+}
 
-	// load .env file
-	err := godotenv.Load(".env")
-
+// runBot publishes the presence until the process receives SIGINT or
+// SIGTERM.
+func runBot(args []string) {
+	config, err := loadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Println("Error loading .env file")
+		log.Fatalf("Invalid configuration:\n%v\n", err)
+	}
+	if err := configureEndpoints(config); err != nil {
+		log.Fatalln("Invalid endpoint configuration:", err)
 	}
-	if err := authenticateLicense(); err != nil {
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// a fatal error while running cancels ctx with the error as cause, so the
+	// bot shuts down like on a signal and exits with an error afterwards
+	ctx, fail := context.WithCancelCause(signalCtx)
+	defer fail(nil)
+	defer func() {
+		if cause := context.Cause(ctx); cause != context.Cause(signalCtx) {
+			log.Fatalln(cause)
+		}
+	}()
+	context.AfterFunc(ctx, func() {
+		log.Println("Shutting down")
+		time.AfterFunc(shutdownTimeout, func() {
+			log.Println("Shutdown did not finish within", shutdownTimeout)
+			os.Exit(1)
+		})
+	})
+
+	warnWithoutLicenseGrace(config.License)
+	license, err := authenticateLicense(ctx, config)
+	if err != nil {
 		log.Fatalln("License validation failed:", err)
 	}
-	go periodicLicenseCheck()
 	latestVersion = Release{TagName: version, Url: ""}
 
+	// with PRESENCE_USERS or PRESENCE_GROUPS the bot monitors several users
+	// with an app-only token instead of the signed-in user
+	var me User
+	var tokens *token.Manager
+	var topics Topics
+	var describe func(mqtt.Client)
+	var setDevice func(Device)
+	var team *teamMonitor
+	if config.Presence.team() {
+		topics, err = topicsFromConfig(config, "team")
+		if err != nil {
+			log.Fatalln("Invalid topic configuration:", err)
+		}
+		team = teamMonitorFromConfig(graphClient, topics, config.Presence)
+		if err := team.resolve(ctx); err != nil {
+			log.Fatalln("Error resolving team members:", err)
+		}
+		describe = team.sendDiscovery
+	} else {
+		tokens, err = token.Default()
+		if err != nil {
+			log.Fatalln("Invalid token configuration:", err)
+		}
+		// with HA_NODE_ID the topics do not depend on the user, so the bot
+		// connects to the broker first and a device code login on startup is
+		// shown in Home Assistant
+		if config.HomeAssistant.NodeID == "" {
+			me, err = signIn(ctx, tokens)
+			if err != nil {
+				log.Fatalln("Error requesting signed-in user:", err)
+			}
+		}
+		topics, err = topicsFromConfig(config, me.UserPrincipalName)
+		if err != nil {
+			log.Fatalln("Invalid topic configuration:", err)
+		}
+		var deviceMu sync.Mutex
+		device := newDevice(topics, me.DisplayName)
+		describe = func(client mqtt.Client) {
+			deviceMu.Lock()
+			current := device
+			deviceMu.Unlock()
+			sendDeviceDescriptionMqtt(client, topics, current)
+		}
+		setDevice = func(d Device) {
+			deviceMu.Lock()
+			device = d
+			deviceMu.Unlock()
+		}
+	}
+
 	// initialize mqtt client
-	port, _ := strconv.Atoi(os.Getenv("MQTT_PORT"))
-	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s:%d", os.Getenv("MQTT_HOST"), port))
+	broker, err := mqttBrokerURL(config.MQTT)
+	if err != nil {
+		log.Fatalln("Invalid MQTT broker:", err)
+	}
+	tlsConfig, err := mqttTLSConfig(config.MQTT)
+	if err != nil {
+		log.Fatalln("Invalid MQTT TLS configuration:", err)
+	}
+	opts := mqtt.NewClientOptions().AddBroker(broker.String())
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
 	opts.SetClientID(fmt.Sprintf("go-presence-bot-%v", time.Now().UnixNano()))
 	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
 		log.Printf("TOPIC: %s\n", msg.Topic())
@@ -119,158 +207,320 @@ func main() {
 	})
 	opts.SetPingTimeout(1 * time.Second)
 	opts.SetKeepAlive(2 * time.Second)
-	opts.SetAutoReconnect(false)
-	opts.SetMaxReconnectInterval(15 * time.Second)
-	opts.SetUsername(os.Getenv("MQTT_USER"))
-	opts.SetPassword(os.Getenv("MQTT_PASSWORD"))
-	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
-		panic("MQTT connection lost: " + err.Error())
+	// the credentials are read on every connect
+	user := config.secret("MQTT_USER", config.MQTT.User)
+	password := config.secret("MQTT_PASSWORD", config.MQTT.Password)
+	opts.SetCredentialsProvider(func() (string, string) {
+		return user(), password()
 	})
-	opts.SetOnConnectHandler(func(client mqtt.Client) {
-		fmt.Println("Connected as", opts.ClientID)
-		sendDeviceDescriptionMqtt(client)
+	connection := newMQTTConnection(opts, topics, func(client mqtt.Client) {
+		describe(client)
+		if team == nil {
+			subscribeCommands(ctx, client, topics, config.Presence)
+		}
 	})
-	client := mqtt.NewClient(opts)
-	if mqttToken := client.Connect(); mqttToken.Wait() && mqttToken.Error() != nil {
-		panic(mqttToken.Error())
+	// the offline availability is published before the bot exits, closing
+	// also stops a pending connect
+	defer connection.Close()
+	context.AfterFunc(ctx, connection.Close)
+	heartbeat := heartbeatInterval(config.HomeAssistant.HeartbeatInterval)
+	if team == nil {
+		// a device code login is shown in Home Assistant
+		go newLoginMonitor(connection, topics).Run(ctx, heartbeat)
+	}
+	connection.Connect()
+	go func() {
+		if err := newLicenseMonitor(connection, topics, config).Run(ctx, license); err != nil {
+			fail(err)
+		}
+	}()
+	go updateCheck(ctx)
+	go sendDeviceDescription(ctx, connection, describe)
+
+	if team != nil {
+		team.Run(ctx, connection, heartbeat)
+		return
+	}
+
+	if me.Id == "" {
+		me, err = signIn(ctx, tokens)
+		if err != nil {
+			fail(fmt.Errorf("request signed-in user: %w", err))
+			return
+		}
+		setDevice(newDevice(topics, me.DisplayName))
+		if connection.IsConnected() {
+			describe(connection.client)
+		}
+	}
+	// the access token is refreshed before it expires
+	go tokens.Run(ctx)
+
+	// while Graph throttles the bot, the last known presence is kept
+	throttle := newGraphThrottle()
+	poller := newPresencePoller(func() (Presence, error) {
+		accessToken, err := tokens.Token(ctx)
+		if err != nil {
+			return Presence{Availability: "unknown", Activity: "unknown"}, err
+		}
+		requestCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+		return getPresence(requestCtx, graphClient, accessToken.Token)
+	}, throttle)
+	currentPresence := poller.Current
+	if strings.EqualFold(config.Presence.Mode, "subscription") {
+		currentPresence = startPresenceSubscription(ctx, config.Presence, me, tokens, poller.Current)
 	}
-	go updateCheck()
-	go sendDeviceDescription(client)
+
+	var lastPresence *Presence
+	var lastVersion Version
+	var lastGraphStatus GraphStatus
+	var lastPublished time.Time
 	ticker := time.NewTicker(1 * time.Second)
-	for range ticker.C {
-		// check if client is still connected, else panic
-		if !client.IsConnected() {
-			panic("MQTT client is not connected")
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		presence := currentPresence()
+		if ctx.Err() != nil {
+			// requests cancelled by the shutdown report an unknown presence
+			return
+		}
+		v := Version{Version: version, Latest: latestVersion}
+		graphStatus := throttle.Status()
+		unchanged := lastPresence != nil && presence.Equal(*lastPresence) && v == lastVersion && graphStatus == lastGraphStatus
+		if unchanged && time.Since(lastPublished) < heartbeat {
+			continue
 		}
-		presence := getPresence(token.GetToken())
 		presenceJson, _ := json.Marshal(presence)
-		fmt.Println(string(presenceJson))
+		if !unchanged {
+			fmt.Println(string(presenceJson))
+		}
 
-		token := client.Publish("msteams/presence", 0, false, string(presenceJson))
-		go func() {
-			token.Wait()
-			if token.Error() != nil {
-				log.Panicln("Error publishing presence:", token.Error())
-			}
-		}()
-		v := Version{Version: version, Latest: latestVersion}
+		// while the broker is unreachable only the latest state is kept and
+		// published after reconnecting
+		connection.Publish(topics.Presence(), 0, true, string(presenceJson))
 		versionJson, _ := json.Marshal(v)
-		versionToken := client.Publish("msteams/version", 0, false, versionJson)
-		go func() {
-			versionToken.Wait()
-			if versionToken.Error() != nil {
-				log.Panicln("Error publishing version:", versionToken.Error())
-			}
-		}()
+		connection.Publish(topics.Version(), 0, true, versionJson)
+		graphJson, _ := json.Marshal(graphStatus)
+		connection.Publish(topics.Graph(), 0, true, graphJson)
+		lastPresence = &presence
+		lastVersion = v
+		lastGraphStatus = graphStatus
+		lastPublished = time.Now()
 	}
 }
 
-func getPresence(token token.Token) Presence {
-	presence := Presence{
-		Availability:  "unknown",
-		Activity:      "unknown",
-		StatusMessage: nil,
-	}
-	// get presence from microsoft graph api
-	url := "https://graph.microsoft.com/v1.0/me/presence"
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Println("Error requesting presence", err)
-		return presence
-	}
-	req.Header.Add("Authorization", "Bearer "+token.Token)
-	data, err := http.DefaultClient.Do(req)
+// signIn requests the token of the signed-in user, signing in with the
+// device code flow if needed, and returns the user.
+func signIn(ctx context.Context, tokens *token.Manager) (User, error) {
+	accessToken, err := tokens.Token(ctx)
 	if err != nil {
-		log.Println("Error requesting presence", err)
-		return presence
+		return User{}, err
 	}
-	defer func() {
-		err := data.Body.Close()
-		if err != nil {
-			log.Fatalln("Error closing response body", err)
-		}
-	}()
+	return getMe(ctx, graphClient, accessToken.Token)
+}
 
-	if data.StatusCode != 200 {
-		log.Println("Error requesting presence", data.StatusCode)
-		return presence
+// heartbeatInterval returns how often an unchanged state is published again.
+// It has to stay below expiration, otherwise Home Assistant marks the sensors
+// as unavailable while nothing changes.
+func heartbeatInterval(value string) time.Duration {
+	maximum := time.Duration(expiration) * time.Second
+	heartbeat := maximum / 2
+	if value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			log.Printf("Ignoring invalid HEARTBEAT_INTERVAL %q\n", value)
+		} else if time.Duration(seconds)*time.Second >= maximum {
+			log.Printf("HEARTBEAT_INTERVAL must be below %d seconds, using %s\n", expiration, heartbeat)
+		} else {
+			heartbeat = time.Duration(seconds) * time.Second
+		}
 	}
+	return heartbeat
+}
 
-	body, err := io.ReadAll(data.Body)
+// startPresenceSubscription starts the webhook receiver and the Graph
+// subscription and returns a function reporting the current presence.
+func startPresenceSubscription(ctx context.Context, config PresenceConfig, me User, tokens *token.Manager, poll func() Presence) func() Presence {
+	notificationURL := config.WebhookURL
+	if notificationURL == "" {
+		log.Fatalln("WEBHOOK_URL is required when PRESENCE_MODE is subscription")
+	}
+	listen := config.WebhookListen
+	if listen == "" {
+		listen = ":8443"
+	}
+	subscriber, err := newPresenceSubscriber(graphClient, notificationURL, tokens.Token, poll)
 	if err != nil {
-		log.Println("Error reading response body", err)
-		return presence
+		log.Fatalln("Error preparing presence subscription:", err)
 	}
-	json.Unmarshal(body, &presence)
+	go serveWebhook(ctx, listen, config.WebhookTLSCert, config.WebhookTLSKey, subscriber)
+	go subscriber.Run(ctx, me.Id)
+	return subscriber.Current
+}
 
-	return presence
+func getPresence(ctx context.Context, client *http.Client, accessToken string) (Presence, error) {
+	presence := Presence{
+		Availability:  "unknown",
+		Activity:      "unknown",
+		StatusMessage: nil,
+	}
+	// get presence from microsoft graph api
+	if err := graphRequest(ctx, client, http.MethodGet, "/me/presence", accessToken, nil, &presence); err != nil {
+		return Presence{Availability: "unknown", Activity: "unknown"}, err
+	}
+	return presence, nil
 }
 
-func sendDeviceDescription(client mqtt.Client) {
+func sendDeviceDescription(ctx context.Context, connection *mqttConnection, describe func(mqtt.Client)) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
-	for range ticker.C {
-		sendDeviceDescriptionMqtt(client)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// the discovery is sent on every connect, so skip it while offline
+		if connection.IsConnected() {
+			describe(connection.client)
+		}
+	}
+}
+
+type discoveryEntity struct {
+	component string
+	objectID  string
+	config    HomeassistantDevice
+}
+
+func newDevice(topics Topics, displayName string) Device {
+	name := "Teams Status"
+	if displayName != "" {
+		name += " " + displayName
+	}
+	return Device{
+		Manufacturer: "Rindula",
+		Model:        "Go",
+		Name:         name,
+		SwVersion:    version,
+		Identifiers:  "msteams_presence_" + topics.NodeID,
 	}
 }
 
-func sendDeviceDescriptionMqtt(client mqtt.Client) {
-	sensor_availability := HomeassistantDevice{
-		Name:             "Teams Availability",
-		AvailabilityMode: "all",
-		Device:           device,
-		UniqueId:         "teams_presence_availability",
-		StateTopic:       "msteams/presence",
-		ValueTemplate:    "{{ value_json.availability }}",
-		ExpireAfter:      int(expiration),
-		Icon:             "mdi:eye",
+// presenceEntities returns the read-only presence sensors of a user.
+func presenceEntities(topics Topics) []discoveryEntity {
+	return []discoveryEntity{
+		{component: "sensor", objectID: "availability", config: HomeassistantDevice{
+			Name:          "Teams Availability",
+			StateTopic:    topics.Presence(),
+			ValueTemplate: "{{ value_json.availability }}",
+			ExpireAfter:   int(expiration),
+			Icon:          "mdi:eye",
+		}},
+		{component: "sensor", objectID: "activity", config: HomeassistantDevice{
+			Name:          "Teams Activity",
+			StateTopic:    topics.Presence(),
+			ValueTemplate: "{{ value_json.activity }}",
+			ExpireAfter:   int(expiration),
+			Icon:          "mdi:eye",
+		}},
+		{component: "sensor", objectID: "status", config: HomeassistantDevice{
+			Name:                "Teams Status Message",
+			StateTopic:          topics.Presence(),
+			ValueTemplate:       "{{ value_json.statusMessage.message.content }}",
+			ExpireAfter:         int(expiration),
+			Icon:                "mdi:eye",
+			DeviceClass:         homeassistant.DeviceClassNone,
+			PayloadNotAvailable: "",
+		}},
 	}
+}
 
-	sensor_activity := HomeassistantDevice{
-		Name:             "Teams Activity",
-		AvailabilityMode: "all",
-		Device:           device,
-		UniqueId:         "teams_presence_activity",
-		StateTopic:       "msteams/presence",
-		ValueTemplate:    "{{ value_json.activity }}",
-		ExpireAfter:      int(expiration),
-		Icon:             "mdi:eye",
+// diagnosticEntities returns the diagnostic entities of the bot.
+func diagnosticEntities(topics Topics) []discoveryEntity {
+	entities := []discoveryEntity{
+		{component: "sensor", objectID: "update", config: HomeassistantDevice{
+			Name:                  "Teams Status Update",
+			StateTopic:            topics.Version(),
+			ValueTemplate:         "{{ value_json.version }}",
+			ExpireAfter:           int(expiration),
+			Icon:                  "mdi:update",
+			DeviceClass:           homeassistant.DeviceClassFirmware,
+			EntityCategory:        homeassistant.EntityCategoryDiagnostic,
+			LatestVersionTopic:    topics.Version(),
+			LatestVersionTemplate: "{{ value_json.latest.tag_name }}",
+			ReleaseUrl:            "{{ value_json.latest.url }}",
+		}},
+		{component: "sensor", objectID: "mqtt_disconnects", config: HomeassistantDevice{
+			Name:           "Teams MQTT Disconnects",
+			StateTopic:     topics.Connection(),
+			ValueTemplate:  "{{ value_json.disconnects }}",
+			Icon:           "mdi:lan-disconnect",
+			EntityCategory: homeassistant.EntityCategoryDiagnostic,
+		}},
+		{component: "binary_sensor", objectID: "graph_throttled", config: HomeassistantDevice{
+			Name:           "Teams Graph Throttled",
+			StateTopic:     topics.Graph(),
+			ValueTemplate:  "{{ 'ON' if value_json.throttled else 'OFF' }}",
+			Icon:           "mdi:speedometer-slow",
+			EntityCategory: homeassistant.EntityCategoryDiagnostic,
+		}},
 	}
+	return append(entities, licenseEntities(topics)...)
+}
 
-	sensor_status := HomeassistantDevice{
-		Name:                "Teams Status Message",
-		AvailabilityMode:    "all",
-		Device:              device,
-		UniqueId:            "teams_presence_status",
-		StateTopic:          "msteams/presence",
-		ValueTemplate:       "{{ value_json.statusMessage.message.content }}",
-		ExpireAfter:         int(expiration),
-		Icon:                "mdi:eye",
-		DeviceClass:         homeassistant.DeviceClassNone,
-		PayloadNotAvailable: "",
+// controlEntities returns the entities that change the presence of the
+// signed-in user.
+func controlEntities(topics Topics) []discoveryEntity {
+	return []discoveryEntity{
+		{component: "select", objectID: "presence", config: HomeassistantDevice{
+			Name:          "Teams Presence",
+			StateTopic:    topics.Presence(),
+			ValueTemplate: "{% set a = {'AvailableIdle': 'Available', 'BusyIdle': 'Busy'}.get(value_json.availability, value_json.availability) %}{{ a if a in " + presenceOptionsTemplate() + " else '" + presenceResetOption + "' }}",
+			CommandTopic:  topics.PresenceCommand(),
+			Options:       presenceOptions,
+			Icon:          "mdi:account-edit",
+		}},
+		{component: "text", objectID: "status", config: HomeassistantDevice{
+			Name:          "Teams Set Status Message",
+			StateTopic:    topics.Presence(),
+			ValueTemplate: "{{ value_json.statusMessage.message.content if value_json.statusMessage else '' }}",
+			CommandTopic:  topics.StatusMessageCommand(),
+			Max:           statusMessageMaxLength,
+			Icon:          "mdi:message-text",
+		}},
+		{component: "button", objectID: "status_clear", config: HomeassistantDevice{
+			Name:         "Teams Clear Status Message",
+			CommandTopic: topics.StatusMessageClear(),
+			Icon:         "mdi:message-off",
+		}},
 	}
+}
 
-	sensor_update := HomeassistantDevice{
-		Name:                  "Teams Status Update",
-		AvailabilityMode:      "all",
-		Device:                device,
-		UniqueId:              "teams_presence_update",
-		StateTopic:            "msteams/version",
-		ValueTemplate:         "{{ value_json.version }}",
-		ExpireAfter:           int(expiration),
-		Icon:                  "mdi:update",
-		DeviceClass:           homeassistant.DeviceClassFirmware,
-		EntityCategory:        homeassistant.EntityCategoryDiagnostic,
-		LatestVersionTopic:    "msteams/version",
-		LatestVersionTemplate: "{{ value_json.latest.tag_name }}",
-		ReleaseUrl:            "{{ value_json.latest.url }}",
+// publishDiscovery fills in the fields shared by all entities of a device and
+// publishes their discovery configs.
+func publishDiscovery(client mqtt.Client, topics Topics, device Device, availability []Availability, entities []discoveryEntity) {
+	for _, entity := range entities {
+		config := entity.config
+		config.Device = device
+		config.UniqueId = topics.UniqueID(entity.objectID)
+		config.AvailabilityMode = "all"
+		config.Availability = availability
+		configJSON, _ := json.Marshal(config)
+		client.Publish(topics.Discovery(entity.component, entity.objectID), 1, false, string(configJSON))
 	}
-	sensorAvailabilityJSON, _ := json.Marshal(sensor_availability)
-	sensorActivityJSON, _ := json.Marshal(sensor_activity)
-	sensorStatusJSON, _ := json.Marshal(sensor_status)
-	sensorUpdateJSON, _ := json.Marshal(sensor_update)
-	client.Publish("homeassistant/sensor/teams/availability/config", 1, false, string(sensorAvailabilityJSON))
-	client.Publish("homeassistant/sensor/teams/activity/config", 1, false, string(sensorActivityJSON))
-	client.Publish("homeassistant/sensor/teams/status/config", 1, false, string(sensorStatusJSON))
-	client.Publish("homeassistant/sensor/teams/update/config", 1, false, string(sensorUpdateJSON))
+}
+
+// sendDeviceDescriptionMqtt publishes the entities of the signed-in user. The
+// presence and its controls are unavailable while a login is pending.
+func sendDeviceDescriptionMqtt(client mqtt.Client, topics Topics, device Device) {
+	availability := topics.availability()
+	publishDiscovery(client, topics, device, availability, append(diagnosticEntities(topics), loginEntities(topics)...))
+	signedIn := append(availability, topics.loginAvailability())
+	publishDiscovery(client, topics, device, signedIn, append(presenceEntities(topics), controlEntities(topics)...))
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const mqttMinReconnectDelay = 1 * time.Second
+const mqttMaxReconnectDelay = 2 * time.Minute
+
+// The availability topic carries the retained online/offline state of the
+// bot. The broker publishes offline as last will if the bot disappears without
+// saying goodbye.
+const payloadOnline = "online"
+const payloadOffline = "offline"
+
+type pendingMessage struct {
+	qos      byte
+	retained bool
+	payload  any
+}
+
+type ConnectionStats struct {
+	Disconnects int64 `json:"disconnects"`
+	Reconnects  int64 `json:"reconnects"`
+}
+
+// mqttConnection wraps the paho client with a reconnect loop using
+// exponential backoff with jitter. Messages published while the broker is
+// unreachable are buffered, keeping only the latest payload per topic, and
+// sent once the connection is back.
+type mqttConnection struct {
+	client    mqtt.Client
+	topics    Topics
+	onConnect func(mqtt.Client)
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	reconnecting atomic.Bool
+	connects     atomic.Int64
+	disconnects  atomic.Int64
+
+	mu      sync.Mutex
+	pending map[string]pendingMessage
+}
+
+// newMQTTConnection creates the client from opts. onConnect is called after
+// every successful connect, before buffered messages are flushed.
+func newMQTTConnection(opts *mqtt.ClientOptions, topics Topics, onConnect func(mqtt.Client)) *mqttConnection {
+	c := &mqttConnection{
+		topics:    topics,
+		onConnect: onConnect,
+		closed:    make(chan struct{}),
+		pending:   map[string]pendingMessage{},
+	}
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+	opts.SetWill(topics.Availability(), payloadOffline, 1, true)
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		disconnects := c.disconnects.Add(1)
+		log.Printf("MQTT connection lost (%d disconnects): %v\n", disconnects, err)
+		if !c.isClosed() {
+			go c.connect()
+		}
+	})
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		c.connects.Add(1)
+		log.Println("Connected to MQTT broker as", opts.ClientID)
+		if c.onConnect != nil {
+			c.onConnect(client)
+		}
+		c.Publish(topics.Availability(), 1, true, payloadOnline)
+		stats, _ := json.Marshal(c.Stats())
+		c.Publish(topics.Connection(), 0, true, stats)
+		c.flush()
+	})
+	c.client = mqtt.NewClient(opts)
+	return c
+}
+
+// Connect blocks until the first connection to the broker is established or
+// the connection is closed.
+func (c *mqttConnection) Connect() {
+	c.connect()
+}
+
+func (c *mqttConnection) connect() {
+	if !c.reconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	defer c.reconnecting.Store(false)
+	for attempt := 0; !c.isClosed(); attempt++ {
+		token := c.client.Connect()
+		if token.Wait() && token.Error() == nil {
+			if c.isClosed() {
+				// Close raced with the connect
+				c.client.Disconnect(0)
+			}
+			return
+		}
+		delay := reconnectDelay(attempt)
+		log.Printf("Error connecting to MQTT broker, retrying in %s: %v\n", delay.Round(time.Millisecond), token.Error())
+		timer := time.NewTimer(delay)
+		select {
+		case <-c.closed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *mqttConnection) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// reconnectDelay doubles the delay for every attempt up to
+// mqttMaxReconnectDelay and picks a random duration in its upper half, so
+// several bots do not hammer a restarting broker at the same moment.
+func reconnectDelay(attempt int) time.Duration {
+	delay := mqttMaxReconnectDelay
+	if attempt < 16 {
+		delay = min(mqttMinReconnectDelay<<attempt, mqttMaxReconnectDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Close marks the bot as offline, disconnects from the broker and stops
+// reconnecting. Further calls wait for the first one to finish.
+func (c *mqttConnection) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.client.IsConnectionOpen() {
+			token := c.client.Publish(c.topics.Availability(), 1, true, payloadOffline)
+			if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+				log.Println("Error publishing offline availability:", token.Error())
+			}
+		}
+		c.client.Disconnect(250)
+	})
+}
+
+func (c *mqttConnection) IsConnected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+func (c *mqttConnection) Stats() ConnectionStats {
+	return ConnectionStats{
+		Disconnects: c.disconnects.Load(),
+		Reconnects:  max(c.connects.Load()-1, 0),
+	}
+}
+
+// Publish sends payload to topic. While disconnected, the payload replaces any
+// earlier buffered payload for the same topic.
+func (c *mqttConnection) Publish(topic string, qos byte, retained bool, payload any) {
+	message := pendingMessage{qos: qos, retained: retained, payload: payload}
+	if !c.client.IsConnectionOpen() {
+		c.buffer(topic, message)
+		return
+	}
+	token := c.client.Publish(topic, qos, retained, payload)
+	go func() {
+		token.Wait()
+		if token.Error() != nil {
+			log.Println("Error publishing to", topic+":", token.Error())
+		}
+	}()
+}
+
+func (c *mqttConnection) buffer(topic string, message pendingMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[topic] = message
+}
+
+func (c *mqttConnection) flush() {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = map[string]pendingMessage{}
+	c.mu.Unlock()
+	for topic, message := range pending {
+		c.Publish(topic, message.qos, message.retained, message.payload)
+	}
+}
+
+var mqttDefaultPorts = map[string]string{
+	"tcp":      "1883",
+	"mqtt":     "1883",
+	"ssl":      "8883",
+	"tls":      "8883",
+	"mqtts":    "8883",
+	"mqtt+ssl": "8883",
+	"tcps":     "8883",
+	"ws":       "80",
+	"wss":      "443",
+}
+
+// mqttBrokerURL returns the broker from MQTT_URL, falling back to
+// tcp://MQTT_HOST:MQTT_PORT. A missing port is filled in from the scheme.
+func mqttBrokerURL(config MQTTConfig) (*url.URL, error) {
+	raw := strings.TrimSpace(config.URL)
+	if raw == "" {
+		port := strings.TrimSpace(config.Port)
+		if port == "" {
+			port = "1883"
+		}
+		if _, err := strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("MQTT_PORT %q is not a number", port)
+		}
+		raw = fmt.Sprintf("tcp://%s", net.JoinHostPort(config.Host, port))
+	}
+	broker, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse MQTT_URL: %w", err)
+	}
+	broker.Scheme = strings.ToLower(broker.Scheme)
+	defaultPort, ok := mqttDefaultPorts[broker.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported MQTT scheme %q", broker.Scheme)
+	}
+	if broker.Hostname() == "" {
+		return nil, fmt.Errorf("MQTT broker %q has no host", raw)
+	}
+	if broker.Port() == "" {
+		broker.Host = net.JoinHostPort(broker.Hostname(), defaultPort)
+	}
+	return broker, nil
+}
+
+// mqttTLSConfig builds the TLS configuration from MQTT_CA_FILE,
+// MQTT_CLIENT_CERT_FILE, MQTT_CLIENT_KEY_FILE and MQTT_TLS_INSECURE. It
+// returns nil if none of them is set.
+func mqttTLSConfig(mqttConfig MQTTConfig) (*tls.Config, error) {
+	caFile := mqttConfig.CAFile
+	certFile := mqttConfig.ClientCertFile
+	keyFile := mqttConfig.ClientKeyFile
+	insecure, _ := strconv.ParseBool(mqttConfig.TLSInsecure)
+	if caFile == "" && certFile == "" && keyFile == "" && !insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecure}
+	if insecure {
+		log.Println("MQTT_TLS_INSECURE is set, the broker certificate is not verified")
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read MQTT_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("MQTT_CA_FILE %s contains no certificates", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("MQTT_CLIENT_CERT_FILE and MQTT_CLIENT_KEY_FILE must be set together")
+		}
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load MQTT client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
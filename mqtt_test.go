@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+var testTopics = Topics{Base: "test", DiscoveryPrefix: "homeassistant", NodeID: "test"}
+
+// testBroker runs an in-process MQTT broker and records the published
+// payloads per topic.
+type testBroker struct {
+	t       *testing.T
+	address string
+	server  *broker.Server
+
+	mu       sync.Mutex
+	messages map[string][]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	b := &testBroker{t: t, address: address, messages: map[string][]string{}}
+	b.start()
+	return b
+}
+
+func (b *testBroker) start() {
+	b.server = broker.New(&broker.Options{InlineClient: true})
+	if err := b.server.AddHook(new(auth.AllowHook), nil); err != nil {
+		b.t.Fatal(err)
+	}
+	if err := b.server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: b.address})); err != nil {
+		b.t.Fatal(err)
+	}
+	if err := b.server.Serve(); err != nil {
+		b.t.Fatal(err)
+	}
+	err := b.server.Subscribe("#", 1, func(_ *broker.Client, _ packets.Subscription, pk packets.Packet) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.messages[pk.TopicName] = append(b.messages[pk.TopicName], string(pk.Payload))
+	})
+	if err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+func (b *testBroker) stop() {
+	b.server.Close()
+}
+
+func (b *testBroker) waitFor(topic, payload string) {
+	b.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		for _, message := range b.messages[topic] {
+			if message == payload {
+				b.mu.Unlock()
+				return
+			}
+		}
+		b.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.t.Fatalf("no message %q on %s, got %v", payload, topic, b.messages[topic])
+}
+
+func waitUntil(t *testing.T, condition func() bool, message string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(message)
+}
+
+func TestMQTTConnectionSurvivesBrokerRestart(t *testing.T) {
+	b := newTestBroker(t)
+	defer func() { b.stop() }()
+
+	var mu sync.Mutex
+	connects := 0
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", b.address))
+	opts.SetClientID("test-bot")
+	opts.SetKeepAlive(time.Second)
+	opts.SetPingTimeout(time.Second)
+	connection := newMQTTConnection(opts, testTopics, func(client mqtt.Client) {
+		mu.Lock()
+		connects++
+		mu.Unlock()
+		client.Publish("test/discovery", 1, false, "config")
+	})
+	connection.Connect()
+	defer connection.client.Disconnect(0)
+
+	connection.Publish("test/presence", 0, false, "Available")
+	b.waitFor("test/presence", "Available")
+	b.waitFor("test/discovery", "config")
+
+	b.stop()
+	waitUntil(t, func() bool { return !connection.IsConnected() }, "connection loss was not detected")
+	connection.Publish("test/presence", 0, false, "Busy")
+	connection.Publish("test/presence", 0, false, "Away")
+
+	b.mu.Lock()
+	b.messages = map[string][]string{}
+	b.mu.Unlock()
+	b.start()
+
+	b.waitFor("test/presence", "Away")
+	b.waitFor("test/discovery", "config")
+	b.waitFor(testTopics.Connection(), `{"disconnects":1,"reconnects":1}`)
+	// the stats are retained, so Home Assistant shows them after a restart
+	if retained := b.server.Topics.Messages(testTopics.Connection()); len(retained) != 1 || string(retained[0].Payload) != `{"disconnects":1,"reconnects":1}` {
+		t.Fatalf("retained stats = %v", retained)
+	}
+	b.mu.Lock()
+	if presences := b.messages["test/presence"]; len(presences) != 1 {
+		t.Fatalf("buffered presences = %v", presences)
+	}
+	b.mu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	if connects != 2 {
+		t.Fatalf("connects = %d", connects)
+	}
+	if stats := connection.Stats(); stats.Disconnects != 1 || stats.Reconnects != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	for attempt := range 30 {
+		delay := reconnectDelay(attempt)
+		upper := mqttMaxReconnectDelay
+		if attempt < 8 {
+			upper = min(mqttMinReconnectDelay<<attempt, mqttMaxReconnectDelay)
+		}
+		if delay < upper/2 || delay > upper {
+			t.Fatalf("attempt %d: delay %s outside [%s, %s]", attempt, delay, upper/2, upper)
+		}
+	}
+}
+
+func TestMQTTConnectionPublishesAvailability(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.stop()
+
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", b.address))
+	opts.SetClientID("test-bot")
+	connection := newMQTTConnection(opts, testTopics, nil)
+	connection.Connect()
+	b.waitFor(testTopics.Availability(), payloadOnline)
+
+	connection.Close()
+	b.waitFor(testTopics.Availability(), payloadOffline)
+	if connection.IsConnected() {
+		t.Fatal("connection is still open after Close")
+	}
+}
+
+func TestMQTTConnectionCloseStopsConnecting(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", address))
+	opts.SetClientID("test-bot")
+	connection := newMQTTConnection(opts, testTopics, nil)
+	done := make(chan struct{})
+	go func() {
+		connection.Connect()
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	connection.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connect kept retrying after Close")
+	}
+}
+
+func TestMQTTBrokerURL(t *testing.T) {
+	tests := []struct {
+		url, host, port string
+		want            string
+	}{
+		{host: "broker", port: "1884", want: "tcp://broker:1884"},
+		{host: "broker", want: "tcp://broker:1883"},
+		{url: "mqtts://broker", want: "mqtts://broker:8883"},
+		{url: "SSL://broker:9999", want: "ssl://broker:9999"},
+		{url: "ws://broker/mqtt", want: "ws://broker:80/mqtt"},
+		{url: "wss://proxy.example.com/mqtt", want: "wss://proxy.example.com:443/mqtt"},
+	}
+	for _, test := range tests {
+		broker, err := mqttBrokerURL(MQTTConfig{URL: test.url, Host: test.host, Port: test.port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if broker.String() != test.want {
+			t.Errorf("broker = %s, want %s", broker, test.want)
+		}
+	}
+
+	if _, err := mqttBrokerURL(MQTTConfig{URL: "http://broker"}); err == nil {
+		t.Fatal("unsupported scheme was accepted")
+	}
+}
+
+// writeTestCertificate creates a certificate signed by parent (or self-signed
+// if parent is nil) and writes it and its key as PEM files to dir.
+func writeTestCertificate(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	certificate, _ := x509.ParseCertificate(der)
+	return certificate, key
+}
+
+func TestMQTTConnectionWithMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeTestCertificate(t, dir, "ca", &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "Test CA"}, NotAfter: notAfter,
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeTestCertificate(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "broker"}, NotAfter: notAfter,
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeTestCertificate(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "bot"}, NotAfter: notAfter,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverCertificate, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	server := broker.New(nil)
+	server.AddHook(new(auth.AllowHook), nil)
+	listener := listeners.NewTCP(listeners.Config{ID: "tls", Address: "127.0.0.1:0", TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}})
+	if err := server.AddListener(listener); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	config := MQTTConfig{
+		URL:            "mqtts://" + listener.Address(),
+		CAFile:         filepath.Join(dir, "ca.crt"),
+		ClientCertFile: filepath.Join(dir, "client.crt"),
+		ClientKeyFile:  filepath.Join(dir, "client.key"),
+	}
+	brokerURL, err := mqttBrokerURL(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := mqttTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := mqtt.NewClientOptions().AddBroker(brokerURL.String()).SetTLSConfig(tlsConfig)
+	opts.SetClientID("test-bot")
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	client.Disconnect(0)
+
+	config.ClientKeyFile = ""
+	if _, err := mqttTLSConfig(config); err == nil {
+		t.Fatal("client certificate without key was accepted")
+	}
+}
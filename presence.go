@@ -5,8 +5,14 @@ type Message struct {
 	ContentType string `json:"contentType,omitempty"`
 }
 
+type DateTimeTimeZone struct {
+	DateTime string `json:"dateTime"`
+	TimeZone string `json:"timeZone"`
+}
+
 type StatusMessage struct {
-	Message Message `json:"message"`
+	Message        Message           `json:"message"`
+	ExpiryDateTime *DateTimeTimeZone `json:"expiryDateTime,omitempty"`
 }
 
 type Presence struct {
@@ -14,3 +20,21 @@ type Presence struct {
 	Activity      string         `json:"activity"`
 	StatusMessage *StatusMessage `json:"statusMessage"`
 }
+
+// Equal reports whether both presences show the same availability, activity
+// and status message.
+func (p Presence) Equal(other Presence) bool {
+	if p.Availability != other.Availability || p.Activity != other.Activity {
+		return false
+	}
+	if p.StatusMessage == nil || other.StatusMessage == nil {
+		return p.StatusMessage == other.StatusMessage
+	}
+	if p.StatusMessage.Message.Content != other.StatusMessage.Message.Content {
+		return false
+	}
+	if p.StatusMessage.ExpiryDateTime == nil || other.StatusMessage.ExpiryDateTime == nil {
+		return p.StatusMessage.ExpiryDateTime == other.StatusMessage.ExpiryDateTime
+	}
+	return *p.StatusMessage.ExpiryDateTime == *other.StatusMessage.ExpiryDateTime
+}
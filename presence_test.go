@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceEqual(t *testing.T) {
+	message := func(content string, expiry *DateTimeTimeZone) *StatusMessage {
+		return &StatusMessage{Message: Message{Content: content}, ExpiryDateTime: expiry}
+	}
+	expiry := &DateTimeTimeZone{DateTime: "2026-10-18T15:00:00", TimeZone: "UTC"}
+	base := Presence{Availability: "Busy", Activity: "InACall", StatusMessage: message("lab", expiry)}
+
+	same := base
+	same.StatusMessage = message("lab", &DateTimeTimeZone{DateTime: "2026-10-18T15:00:00", TimeZone: "UTC"})
+	if !base.Equal(same) {
+		t.Fatal("equal presences differ")
+	}
+	for name, other := range map[string]Presence{
+		"availability": {Availability: "Away", Activity: "InACall", StatusMessage: message("lab", expiry)},
+		"activity":     {Availability: "Busy", Activity: "Busy", StatusMessage: message("lab", expiry)},
+		"message":      {Availability: "Busy", Activity: "InACall", StatusMessage: message("office", expiry)},
+		"expiry":       {Availability: "Busy", Activity: "InACall", StatusMessage: message("lab", nil)},
+		"no message":   {Availability: "Busy", Activity: "InACall"},
+	} {
+		if base.Equal(other) || other.Equal(base) {
+			t.Errorf("%s: presences are equal", name)
+		}
+	}
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"":      60 * time.Second,
+		"30":    30 * time.Second,
+		"120":   60 * time.Second,
+		"-5":    60 * time.Second,
+		"later": 60 * time.Second,
+	} {
+		if got := heartbeatInterval(value); got != want {
+			t.Errorf("HEARTBEAT_INTERVAL=%q: heartbeat = %s, want %s", value, got, want)
+		}
+	}
+}
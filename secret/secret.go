@@ -0,0 +1,100 @@
+// Package secret reads settings that may be mounted as Docker or Kubernetes
+// secret files.
+package secret
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cachedFile struct {
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+var mu sync.Mutex
+var cache = map[string]cachedFile{}
+
+// reported holds the last error logged by Get per path, so a missing file
+// is logged once and not on every read.
+var reported = map[string]string{}
+
+// Get returns the content of the file named by NAME_FILE, or the environment
+// variable NAME if no file is given. Leading and trailing whitespace is
+// trimmed. The file is read again when it changes, so rotated secrets apply
+// without a restart.
+func Get(name string) string {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name)
+	}
+	value, err := read(path)
+	report(name, path, err)
+	return value
+}
+
+// report logs err unless it was the last error logged for path.
+func report(name, path string, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if err == nil {
+		delete(reported, path)
+		return
+	}
+	if reported[path] == err.Error() {
+		return
+	}
+	reported[path] = err.Error()
+	log.Printf("Error reading %s_FILE: %v\n", name, err)
+}
+
+// Lookup is like Get, but reports errors reading the file.
+func Lookup(name string) (string, error) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+	if os.Getenv(name) != "" {
+		return "", fmt.Errorf("%s and %s_FILE are both set", name, name)
+	}
+	value, err := read(path)
+	if err != nil {
+		return "", fmt.Errorf("read %s_FILE: %w", name, err)
+	}
+	return value, nil
+}
+
+func read(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return cached(path), err
+	}
+	mu.Lock()
+	file, ok := cache[path]
+	mu.Unlock()
+	if ok && file.modTime.Equal(info.ModTime()) && file.size == info.Size() {
+		return file.value, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cached(path), err
+	}
+	file = cachedFile{modTime: info.ModTime(), size: info.Size(), value: strings.TrimSpace(string(data))}
+	mu.Lock()
+	cache[path] = file
+	mu.Unlock()
+	return file.value, nil
+}
+
+// cached returns the last value read from path, so a secret being replaced
+// does not clear the setting.
+func cached(path string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	return cache[path].value
+}
@@ -0,0 +1,77 @@
+package secret
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGet(t *testing.T) {
+	t.Setenv("TEST_PASSWORD", "from-env")
+	t.Setenv("TEST_PASSWORD_FILE", "")
+	if got := Get("TEST_PASSWORD"); got != "from-env" {
+		t.Fatalf("Get() = %q", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(path, []byte("  from-file\n"), 0o600)
+	t.Setenv("TEST_PASSWORD", "")
+	t.Setenv("TEST_PASSWORD_FILE", path)
+	if got := Get("TEST_PASSWORD"); got != "from-file" {
+		t.Fatalf("Get() = %q", got)
+	}
+
+	// a rotated secret is read again
+	os.WriteFile(path, []byte("rotated\n"), 0o600)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if got := Get("TEST_PASSWORD"); got != "rotated" {
+		t.Fatalf("Get() after rotation = %q", got)
+	}
+
+	// while the secret is replaced, the last value is kept
+	os.Remove(path)
+	if got := Get("TEST_PASSWORD"); got != "rotated" {
+		t.Fatalf("Get() without file = %q", got)
+	}
+	if _, err := Lookup("TEST_PASSWORD"); err == nil {
+		t.Fatal("Lookup() without file succeeded")
+	}
+}
+
+func TestLookupRejectsBothSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(path, []byte("KEY"), 0o600)
+	t.Setenv("TEST_KEY", "KEY")
+	t.Setenv("TEST_KEY_FILE", path)
+	if _, err := Lookup("TEST_KEY"); err == nil {
+		t.Fatal("Lookup() accepted TEST_KEY and TEST_KEY_FILE")
+	}
+}
+
+func TestGetLogsReadErrorsOnce(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	path := filepath.Join(t.TempDir(), "missing")
+	t.Setenv("TEST_TOKEN", "")
+	t.Setenv("TEST_TOKEN_FILE", path)
+	for range 3 {
+		Get("TEST_TOKEN")
+	}
+	if lines := strings.Count(output.String(), "\n"); lines != 1 {
+		t.Fatalf("logged %d lines:\n%s", lines, output.String())
+	}
+
+	// after the file was readable again, a new error is logged
+	os.WriteFile(path, []byte("token"), 0o600)
+	Get("TEST_TOKEN")
+	os.Remove(path)
+	Get("TEST_TOKEN")
+	if lines := strings.Count(output.String(), "\n"); lines != 2 {
+		t.Fatalf("logged %d lines:\n%s", lines, output.String())
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rindula/msteams-presence-bot-go/token"
+)
+
+// Presence subscriptions live for at most one hour, so they are created
+// slightly shorter and renewed well before they run out.
+const subscriptionLifetime = 55 * time.Minute
+const subscriptionRenewMargin = 5 * time.Minute
+const subscriptionRetryInterval = 5 * time.Minute
+const subscriptionCertificateID = "msteams-presence-bot"
+
+// subscriptionReconcileInterval is how often the presence is polled while
+// subscribed, so a lost notification does not leave it stale until renewal.
+const subscriptionReconcileInterval = 10 * time.Minute
+
+type graphSubscription struct {
+	Id                        string    `json:"id,omitempty"`
+	ChangeType                string    `json:"changeType,omitempty"`
+	NotificationUrl           string    `json:"notificationUrl,omitempty"`
+	LifecycleNotificationUrl  string    `json:"lifecycleNotificationUrl,omitempty"`
+	Resource                  string    `json:"resource,omitempty"`
+	ExpirationDateTime        time.Time `json:"expirationDateTime"`
+	ClientState               string    `json:"clientState,omitempty"`
+	IncludeResourceData       bool      `json:"includeResourceData,omitempty"`
+	EncryptionCertificate     string    `json:"encryptionCertificate,omitempty"`
+	EncryptionCertificateId   string    `json:"encryptionCertificateId,omitempty"`
+	LatestSupportedTlsVersion string    `json:"latestSupportedTlsVersion,omitempty"`
+}
+
+type encryptedContent struct {
+	Data                    string `json:"data"`
+	DataSignature           string `json:"dataSignature"`
+	DataKey                 string `json:"dataKey"`
+	EncryptionCertificateId string `json:"encryptionCertificateId"`
+}
+
+type changeNotification struct {
+	SubscriptionId   string            `json:"subscriptionId"`
+	ClientState      string            `json:"clientState"`
+	ChangeType       string            `json:"changeType,omitempty"`
+	LifecycleEvent   string            `json:"lifecycleEvent,omitempty"`
+	Resource         string            `json:"resource,omitempty"`
+	EncryptedContent *encryptedContent `json:"encryptedContent,omitempty"`
+}
+
+type changeNotificationCollection struct {
+	Value []changeNotification `json:"value"`
+}
+
+// presenceSubscriber keeps the presence up to date through Graph change
+// notifications. While no subscription is active it falls back to polling.
+type presenceSubscriber struct {
+	client          *http.Client
+	notificationURL string
+	clientState     string
+	key             *rsa.PrivateKey
+	certificate     string
+	getToken        func(ctx context.Context) (token.Token, error)
+	getPresence     func() Presence
+	reconcile       time.Duration
+
+	wake chan struct{}
+
+	mu           sync.Mutex
+	presence     Presence
+	subscription *graphSubscription
+	// reauthorize is set when Graph requires the subscription to be
+	// reauthorized before it delivers further notifications.
+	reauthorize bool
+}
+
+func newPresenceSubscriber(client *http.Client, notificationURL string, getToken func(ctx context.Context) (token.Token, error), poll func() Presence) (*presenceSubscriber, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generate notification key: %w", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: subscriptionCertificateID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("create notification certificate: %w", err)
+	}
+	clientState := make([]byte, 16)
+	if _, err := rand.Read(clientState); err != nil {
+		return nil, fmt.Errorf("generate client state: %w", err)
+	}
+	return &presenceSubscriber{
+		client:          client,
+		notificationURL: notificationURL,
+		clientState:     hex.EncodeToString(clientState),
+		key:             key,
+		certificate:     base64.StdEncoding.EncodeToString(certificate),
+		getToken:        getToken,
+		getPresence:     poll,
+		reconcile:       subscriptionReconcileInterval,
+		wake:            make(chan struct{}, 1),
+		presence:        Presence{Availability: "unknown", Activity: "unknown"},
+	}, nil
+}
+
+// Current returns the presence received through notifications or polls Graph
+// if no subscription is active.
+func (s *presenceSubscriber) Current() Presence {
+	s.mu.Lock()
+	active := s.subscription != nil
+	presence := s.presence
+	s.mu.Unlock()
+	if active {
+		return presence
+	}
+	return s.refresh()
+}
+
+func (s *presenceSubscriber) refresh() Presence {
+	presence := s.getPresence()
+	s.mu.Lock()
+	s.presence = presence
+	s.mu.Unlock()
+	return presence
+}
+
+// Run creates the subscription for the user and keeps renewing it. If the
+// subscription cannot be created or renewed, the subscriber polls until the
+// next attempt succeeds. While subscribed, the presence is polled every
+// reconcile interval in case notifications were lost. A subscription that
+// Graph requires to be reauthorized is renewed right away. Run returns when
+// ctx is done.
+func (s *presenceSubscriber) Run(ctx context.Context, userID string) {
+	for ctx.Err() == nil {
+		s.mu.Lock()
+		subscription := s.subscription
+		s.mu.Unlock()
+
+		if subscription == nil {
+			created, err := s.subscribe(ctx, userID)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Println("Error creating presence subscription, falling back to polling:", err)
+				s.wait(ctx, subscriptionRetryInterval)
+				continue
+			}
+			log.Println("Presence subscription created, expires", created.ExpirationDateTime.Format(time.RFC3339))
+			s.refresh()
+			s.mu.Lock()
+			s.subscription = &created
+			s.mu.Unlock()
+			continue
+		}
+
+		untilRenewal := time.Until(subscription.ExpirationDateTime.Add(-subscriptionRenewMargin))
+		s.wait(ctx, min(untilRenewal, s.reconcile))
+		s.mu.Lock()
+		current := s.subscription
+		reauthorize := s.reauthorize
+		s.reauthorize = false
+		s.mu.Unlock()
+		if current != subscription || ctx.Err() != nil {
+			// the subscription was removed while sleeping
+			continue
+		}
+		if !reauthorize && untilRenewal > s.reconcile {
+			s.refresh()
+			continue
+		}
+		renewed, err := s.renew(ctx, subscription.Id)
+		s.mu.Lock()
+		if err != nil {
+			log.Println("Error renewing presence subscription, falling back to polling:", err)
+			s.subscription = nil
+		} else {
+			s.subscription = &renewed
+		}
+		s.mu.Unlock()
+		if err == nil && reauthorize {
+			// notifications may have been dropped until the subscription
+			// was reauthorized
+			s.refresh()
+		}
+	}
+}
+
+// wait sleeps for d, until Graph removed the subscription or requires it to
+// be reauthorized, or until ctx is done.
+func (s *presenceSubscriber) wait(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.wake:
+	case <-ctx.Done():
+	}
+}
+
+func (s *presenceSubscriber) subscribe(ctx context.Context, userID string) (graphSubscription, error) {
+	request := graphSubscription{
+		ChangeType:                "updated",
+		NotificationUrl:           s.notificationURL,
+		LifecycleNotificationUrl:  s.notificationURL,
+		Resource:                  fmt.Sprintf("/communications/presences/%s", userID),
+		ExpirationDateTime:        time.Now().Add(subscriptionLifetime).UTC(),
+		ClientState:               s.clientState,
+		IncludeResourceData:       true,
+		EncryptionCertificate:     s.certificate,
+		EncryptionCertificateId:   subscriptionCertificateID,
+		LatestSupportedTlsVersion: "v1_2",
+	}
+	accessToken, err := s.getToken(ctx)
+	if err != nil {
+		return graphSubscription{}, err
+	}
+	var created graphSubscription
+	if err := graphRequest(ctx, s.client, http.MethodPost, "/subscriptions", accessToken.Token, request, &created); err != nil {
+		return graphSubscription{}, err
+	}
+	return created, nil
+}
+
+func (s *presenceSubscriber) renew(ctx context.Context, subscriptionID string) (graphSubscription, error) {
+	request := struct {
+		ExpirationDateTime time.Time `json:"expirationDateTime"`
+	}{ExpirationDateTime: time.Now().Add(subscriptionLifetime).UTC()}
+	accessToken, err := s.getToken(ctx)
+	if err != nil {
+		return graphSubscription{}, err
+	}
+	var renewed graphSubscription
+	if err := graphRequest(ctx, s.client, http.MethodPatch, "/subscriptions/"+subscriptionID, accessToken.Token, request, &renewed); err != nil {
+		return graphSubscription{}, err
+	}
+	return renewed, nil
+}
+
+// ServeHTTP receives validation requests, change notifications and lifecycle
+// notifications from Graph.
+func (s *presenceSubscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if validationToken := r.URL.Query().Get("validationToken"); validationToken != "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, validationToken)
+		return
+	}
+
+	var notifications changeNotificationCollection
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&notifications); err != nil {
+		http.Error(w, "invalid notification", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	for _, notification := range notifications.Value {
+		if !hmac.Equal([]byte(notification.ClientState), []byte(s.clientState)) {
+			log.Println("Ignoring notification with unexpected client state")
+			continue
+		}
+		s.handleNotification(notification)
+	}
+}
+
+func (s *presenceSubscriber) handleNotification(notification changeNotification) {
+	switch notification.LifecycleEvent {
+	case "":
+	case "subscriptionRemoved":
+		log.Println("Presence subscription was removed by Graph, falling back to polling")
+		s.mu.Lock()
+		if s.subscription != nil && s.subscription.Id == notification.SubscriptionId {
+			s.subscription = nil
+		}
+		s.mu.Unlock()
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+		return
+	case "reauthorizationRequired":
+		log.Println("Graph requires the presence subscription to be reauthorized, renewing it")
+		s.mu.Lock()
+		if s.subscription != nil && s.subscription.Id == notification.SubscriptionId {
+			s.reauthorize = true
+		}
+		s.mu.Unlock()
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+		return
+	case "missed":
+		go s.refresh()
+		return
+	default:
+		log.Println("Ignoring lifecycle notification", notification.LifecycleEvent)
+		return
+	}
+
+	if notification.EncryptedContent == nil {
+		go s.refresh()
+		return
+	}
+	data, err := decryptNotification(s.key, *notification.EncryptedContent)
+	if err != nil {
+		log.Println("Error decrypting presence notification:", err)
+		return
+	}
+	presence := Presence{Availability: "unknown", Activity: "unknown"}
+	if err := json.Unmarshal(data, &presence); err != nil {
+		log.Println("Error decoding presence notification:", err)
+		return
+	}
+	s.mu.Lock()
+	s.presence = presence
+	s.mu.Unlock()
+}
+
+// decryptNotification decrypts the resource data of a rich notification as
+// described in https://learn.microsoft.com/graph/change-notifications-with-resource-data
+func decryptNotification(key *rsa.PrivateKey, content encryptedContent) ([]byte, error) {
+	if content.EncryptionCertificateId != subscriptionCertificateID {
+		return nil, fmt.Errorf("unknown encryption certificate %q", content.EncryptionCertificateId)
+	}
+	encryptedKey, err := base64.StdEncoding.DecodeString(content.DataKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode data key: %w", err)
+	}
+	symmetricKey, err := rsa.DecryptOAEP(sha1.New(), nil, key, encryptedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt data key: %w", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(content.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decode data: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(content.DataSignature)
+	if err != nil {
+		return nil, fmt.Errorf("decode data signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, symmetricKey)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return nil, errors.New("data signature mismatch")
+	}
+
+	block, err := aes.NewCipher(symmetricKey)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("data is not a multiple of the block size")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, symmetricKey[:aes.BlockSize]).CryptBlocks(plain, data)
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(plain) {
+		return nil, errors.New("invalid padding")
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+// serveWebhook receives the Graph notifications until ctx is done.
+func serveWebhook(ctx context.Context, addr, certFile, keyFile string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	})
+	defer stop()
+	var err error
+	if certFile != "" && keyFile != "" {
+		log.Println("Listening for Graph notifications on", addr, "(https)")
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		log.Println("Listening for Graph notifications on", addr, "(http, expecting a TLS terminating proxy)")
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("Webhook server stopped:", err)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rindula/msteams-presence-bot-go/token"
+)
+
+// fakeGraph implements the parts of the subscriptions API used by the bot and
+// posts notifications to the registered webhook like Graph does.
+type fakeGraph struct {
+	t      *testing.T
+	reject bool
+
+	mu           sync.Mutex
+	subscription graphSubscription
+	polls        int
+	renewals     int
+}
+
+func (g *fakeGraph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/subscriptions":
+		var request graphSubscription
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			g.t.Fatal(err)
+		}
+		if request.Resource != "/communications/presences/user-1" || !request.IncludeResourceData || request.EncryptionCertificate == "" {
+			g.t.Errorf("subscription request = %+v", request)
+		}
+		if g.reject || !g.validate(request.NotificationUrl) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": "InvalidRequest", "message": "Subscription validation request failed."}})
+			return
+		}
+		request.Id = "subscription-1"
+		g.mu.Lock()
+		g.subscription = request
+		g.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(request)
+	case r.Method == http.MethodPatch && r.URL.Path == "/subscriptions/subscription-1":
+		var request graphSubscription
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			g.t.Fatal(err)
+		}
+		g.mu.Lock()
+		g.renewals++
+		g.subscription.ExpirationDateTime = request.ExpirationDateTime
+		renewed := g.subscription
+		g.mu.Unlock()
+		json.NewEncoder(w).Encode(renewed)
+	case r.Method == http.MethodGet && r.URL.Path == "/me/presence":
+		g.mu.Lock()
+		g.polls++
+		g.mu.Unlock()
+		json.NewEncoder(w).Encode(Presence{Availability: "Away", Activity: "Away"})
+	default:
+		g.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (g *fakeGraph) validate(notificationURL string) bool {
+	resp, err := http.Post(notificationURL+"?validationToken="+url.QueryEscape("token <1>"), "text/plain", nil)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode == http.StatusOK && string(body) == "token <1>"
+}
+
+func (g *fakeGraph) notify(presence Presence, key *rsa.PublicKey) int {
+	g.mu.Lock()
+	subscription := g.subscription
+	g.mu.Unlock()
+	data, _ := json.Marshal(presence)
+	notification := changeNotificationCollection{Value: []changeNotification{{
+		SubscriptionId:   subscription.Id,
+		ClientState:      subscription.ClientState,
+		ChangeType:       "updated",
+		Resource:         "communications/presences('user-1')",
+		EncryptedContent: encryptForTest(g.t, key, subscription.EncryptionCertificateId, data),
+	}}}
+	body, _ := json.Marshal(notification)
+	resp, err := http.Post(subscription.NotificationUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// lifecycle posts a lifecycle notification for the subscription.
+func (g *fakeGraph) lifecycle(event string) int {
+	g.mu.Lock()
+	subscription := g.subscription
+	g.mu.Unlock()
+	notification := changeNotificationCollection{Value: []changeNotification{{
+		SubscriptionId: subscription.Id,
+		ClientState:    subscription.ClientState,
+		LifecycleEvent: event,
+	}}}
+	body, _ := json.Marshal(notification)
+	resp, err := http.Post(subscription.NotificationUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func encryptForTest(t *testing.T, key *rsa.PublicKey, certificateID string, data []byte) *encryptedContent {
+	symmetricKey := make([]byte, 32)
+	rand.Read(symmetricKey)
+	dataKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, symmetricKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	plain := append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	block, _ := aes.NewCipher(symmetricKey)
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, symmetricKey[:aes.BlockSize]).CryptBlocks(encrypted, plain)
+	mac := hmac.New(sha256.New, symmetricKey)
+	mac.Write(encrypted)
+	return &encryptedContent{
+		Data:                    base64.StdEncoding.EncodeToString(encrypted),
+		DataSignature:           base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		DataKey:                 base64.StdEncoding.EncodeToString(dataKey),
+		EncryptionCertificateId: certificateID,
+	}
+}
+
+func newTestSubscriber(t *testing.T, graph *fakeGraph) (*presenceSubscriber, func()) {
+	graphServer := httptest.NewServer(graph)
+	previousBaseURL := graphBaseURL
+	graphBaseURL = graphServer.URL
+
+	subscriber, err := newPresenceSubscriber(graphServer.Client(), "", func(context.Context) (token.Token, error) { return token.Token{Token: "access"}, nil }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriber.getPresence = func() Presence {
+		presence, _ := getPresence(context.Background(), graphServer.Client(), "access")
+		return presence
+	}
+	webhook := httptest.NewServer(subscriber)
+	subscriber.notificationURL = webhook.URL
+
+	return subscriber, func() {
+		webhook.Close()
+		graphServer.Close()
+		graphBaseURL = previousBaseURL
+	}
+}
+
+func waitForSubscription(t *testing.T, subscriber *presenceSubscriber) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		subscriber.mu.Lock()
+		active := subscriber.subscription != nil
+		subscriber.mu.Unlock()
+		if active {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("subscription was not created")
+}
+
+func waitForPresence(t *testing.T, subscriber *presenceSubscriber, availability string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if subscriber.Current().Availability == availability {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("presence = %+v, want availability %q", subscriber.Current(), availability)
+}
+
+func TestPresenceSubscriptionReceivesNotifications(t *testing.T) {
+	graph := &fakeGraph{t: t}
+	subscriber, cleanup := newTestSubscriber(t, graph)
+	defer cleanup()
+
+	go subscriber.Run(t.Context(), "user-1")
+	waitForSubscription(t, subscriber)
+	waitForPresence(t, subscriber, "Away")
+
+	if status := graph.notify(Presence{Availability: "Busy", Activity: "InACall"}, &subscriber.key.PublicKey); status != http.StatusAccepted {
+		t.Fatalf("notification status = %d", status)
+	}
+	waitForPresence(t, subscriber, "Busy")
+	if got := subscriber.Current().Activity; got != "InACall" {
+		t.Fatalf("activity = %q", got)
+	}
+}
+
+func TestPresenceSubscriptionFallsBackToPolling(t *testing.T) {
+	graph := &fakeGraph{t: t, reject: true}
+	subscriber, cleanup := newTestSubscriber(t, graph)
+	defer cleanup()
+
+	if _, err := subscriber.subscribe(t.Context(), "user-1"); err == nil {
+		t.Fatal("rejected subscription was accepted")
+	}
+	if got := subscriber.Current(); got.Availability != "Away" {
+		t.Fatalf("presence = %+v", got)
+	}
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+	if graph.polls != 1 {
+		t.Fatalf("polls = %d", graph.polls)
+	}
+}
+
+func TestPresenceSubscriptionReconcilesWhileSubscribed(t *testing.T) {
+	graph := &fakeGraph{t: t}
+	subscriber, cleanup := newTestSubscriber(t, graph)
+	defer cleanup()
+	subscriber.reconcile = 20 * time.Millisecond
+
+	go subscriber.Run(t.Context(), "user-1")
+	waitForSubscription(t, subscriber)
+	graph.notify(Presence{Availability: "Busy", Activity: "Busy"}, &subscriber.key.PublicKey)
+	// a notification that contradicts Graph is corrected by the next poll
+	waitForPresence(t, subscriber, "Away")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		graph.mu.Lock()
+		polls := graph.polls
+		graph.mu.Unlock()
+		if polls >= 3 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("presence was not polled while subscribed")
+}
+
+func TestPresenceSubscriptionReauthorizesImmediately(t *testing.T) {
+	graph := &fakeGraph{t: t}
+	subscriber, cleanup := newTestSubscriber(t, graph)
+	defer cleanup()
+
+	go subscriber.Run(t.Context(), "user-1")
+	waitForSubscription(t, subscriber)
+	if status := graph.lifecycle("reauthorizationRequired"); status != http.StatusAccepted {
+		t.Fatalf("notification status = %d", status)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		graph.mu.Lock()
+		renewals, polls := graph.renewals, graph.polls
+		graph.mu.Unlock()
+		// the presence is polled once after creating and once after
+		// reauthorizing the subscription
+		if renewals == 1 && polls == 2 {
+			subscriber.mu.Lock()
+			defer subscriber.mu.Unlock()
+			if subscriber.subscription == nil || subscriber.reauthorize {
+				t.Fatalf("subscription = %+v, reauthorize = %v", subscriber.subscription, subscriber.reauthorize)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("subscription was not renewed after reauthorizationRequired")
+}
+
+func TestPresenceSubscriptionIgnoresForeignClientState(t *testing.T) {
+	graph := &fakeGraph{t: t}
+	subscriber, cleanup := newTestSubscriber(t, graph)
+	defer cleanup()
+
+	go subscriber.Run(t.Context(), "user-1")
+	waitForSubscription(t, subscriber)
+	waitForPresence(t, subscriber, "Away")
+
+	graph.mu.Lock()
+	graph.subscription.ClientState = "forged"
+	graph.mu.Unlock()
+	graph.notify(Presence{Availability: "Busy", Activity: "Busy"}, &subscriber.key.PublicKey)
+	time.Sleep(50 * time.Millisecond)
+	if got := subscriber.Current().Availability; got != "Away" {
+		t.Fatalf("availability = %q", got)
+	}
+}
+
+func TestDecryptNotificationRejectsTamperedData(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := encryptForTest(t, &key.PublicKey, subscriptionCertificateID, []byte(`{"availability":"Busy"}`))
+	if _, err := decryptNotification(key, *content); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(content.Data)
+	data[0] ^= 1
+	content.Data = base64.StdEncoding.EncodeToString(data)
+	if _, err := decryptNotification(key, *content); err == nil {
+		t.Fatal("tampered data was accepted")
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rindula/msteams-presence-bot-go/token"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// getPresencesByUserId accepts at most 650 IDs per request.
+const presenceBatchSize = 650
+const teamRefreshInterval = time.Hour
+
+// defaultTeamPollInterval is how often the presences of all members are
+// requested, each request counts against the Graph limits of the tenant.
+const defaultTeamPollInterval = 30 * time.Second
+
+type teamMember struct {
+	User
+	topics Topics
+	device Device
+}
+
+// teamMonitor tracks the presence of several users with an app-only token and
+// publishes one Home Assistant device per user.
+type teamMonitor struct {
+	client   *http.Client
+	topics   Topics
+	userIDs  []string
+	groupIDs []string
+	getToken func(ctx context.Context) (token.Token, error)
+	throttle *graphThrottle
+	interval time.Duration
+
+	mu      sync.Mutex
+	members []teamMember
+}
+
+// splitList splits a comma or whitespace separated list.
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\n' || r == '\t'
+	})
+}
+
+// team reports whether PRESENCE_USERS or PRESENCE_GROUPS are set.
+func (c PresenceConfig) team() bool {
+	return len(splitList(c.Users)) > 0 || len(splitList(c.Groups)) > 0
+}
+
+// teamMonitorFromConfig returns a monitor for PRESENCE_USERS and
+// PRESENCE_GROUPS, or nil if neither is set. The members are published below
+// topics.
+func teamMonitorFromConfig(client *http.Client, topics Topics, config PresenceConfig) *teamMonitor {
+	users := splitList(config.Users)
+	groups := splitList(config.Groups)
+	if len(users) == 0 && len(groups) == 0 {
+		return nil
+	}
+	return &teamMonitor{
+		client:   client,
+		topics:   topics,
+		userIDs:  users,
+		groupIDs: groups,
+		getToken: token.GetAppToken,
+		throttle: newGraphThrottle(),
+		interval: teamPollInterval(config.TeamPollInterval),
+	}
+}
+
+// teamPollInterval parses TEAM_POLL_INTERVAL, defaultTeamPollInterval if it
+// is empty or invalid.
+func teamPollInterval(value string) time.Duration {
+	if value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= time.Second {
+			return d
+		}
+		log.Printf("Ignoring invalid TEAM_POLL_INTERVAL %q\n", value)
+	}
+	return defaultTeamPollInterval
+}
+
+// memberTopics derives the topics of a user below the topics of the bot.
+func (m *teamMonitor) memberTopics(user User) Topics {
+	userSlug := slug(user.UserPrincipalName)
+	if userSlug == "" {
+		userSlug = slug(user.Id)
+	}
+	return Topics{
+		Base:            m.topics.Base + "/" + userSlug,
+		DiscoveryPrefix: m.topics.DiscoveryPrefix,
+		NodeID:          m.topics.NodeID + "_" + userSlug,
+	}
+}
+
+// resolve looks up the configured users and the members of the configured
+// groups.
+func (m *teamMonitor) resolve(ctx context.Context) error {
+	appToken, err := m.getToken(ctx)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	var members []teamMember
+	add := func(user User) {
+		if seen[user.Id] {
+			return
+		}
+		seen[user.Id] = true
+		topics := m.memberTopics(user)
+		name := user.DisplayName
+		if name == "" {
+			name = user.UserPrincipalName
+		}
+		members = append(members, teamMember{User: user, topics: topics, device: newDevice(topics, name)})
+	}
+
+	for _, id := range m.userIDs {
+		var user User
+		path := "/users/" + url.PathEscape(id) + "?$select=id,displayName,userPrincipalName"
+		if err := graphRequest(ctx, m.client, http.MethodGet, path, appToken.Token, nil, &user); err != nil {
+			return fmt.Errorf("look up user %s: %w", id, err)
+		}
+		add(user)
+	}
+	for _, id := range m.groupIDs {
+		path := "/groups/" + url.PathEscape(id) + "/transitiveMembers/microsoft.graph.user?$select=id,displayName,userPrincipalName"
+		for path != "" {
+			var page struct {
+				Value    []User `json:"value"`
+				NextLink string `json:"@odata.nextLink"`
+			}
+			if err := graphRequest(ctx, m.client, http.MethodGet, path, appToken.Token, nil, &page); err != nil {
+				return fmt.Errorf("look up members of group %s: %w", id, err)
+			}
+			for _, user := range page.Value {
+				add(user)
+			}
+			// the next link is an absolute URL, possibly with another host or
+			// version than graphBaseURL
+			path = page.NextLink
+		}
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("PRESENCE_USERS and PRESENCE_GROUPS contain no users")
+	}
+
+	m.mu.Lock()
+	m.members = members
+	m.mu.Unlock()
+	return nil
+}
+
+// removeMembers clears the retained discovery configs and presences of the
+// members of previous that are no longer members, so Home Assistant removes
+// their devices. It returns the removed members.
+func (m *teamMonitor) removeMembers(connection *mqttConnection, previous []teamMember) []teamMember {
+	current := map[string]bool{}
+	for _, member := range m.Members() {
+		current[member.Id] = true
+	}
+	var removed []teamMember
+	for _, member := range previous {
+		if current[member.Id] {
+			continue
+		}
+		log.Println("Removing team member", member.UserPrincipalName)
+		for _, entity := range presenceEntities(member.topics) {
+			connection.Publish(member.topics.Discovery(entity.component, entity.objectID), 1, true, "")
+		}
+		connection.Publish(member.topics.Presence(), 0, true, "")
+		removed = append(removed, member)
+	}
+	return removed
+}
+
+func (m *teamMonitor) Members() []teamMember {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.members
+}
+
+// presences requests the presence of all members in batches.
+func (m *teamMonitor) presences(ctx context.Context) (map[string]Presence, error) {
+	appToken, err := m.getToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	members := m.Members()
+	result := make(map[string]Presence, len(members))
+	for start := 0; start < len(members); start += presenceBatchSize {
+		batch := members[start:min(start+presenceBatchSize, len(members))]
+		request := struct {
+			Ids []string `json:"ids"`
+		}{}
+		for _, member := range batch {
+			request.Ids = append(request.Ids, member.Id)
+		}
+		var response struct {
+			Value []struct {
+				Id string `json:"id"`
+				Presence
+			} `json:"value"`
+		}
+		if err := graphRequest(ctx, m.client, http.MethodPost, "/communications/getPresencesByUserId", appToken.Token, request, &response); err != nil {
+			return nil, err
+		}
+		for _, presence := range response.Value {
+			result[presence.Id] = presence.Presence
+		}
+	}
+	return result, nil
+}
+
+// sendDiscovery publishes the discovery configs of the bot and all members.
+func (m *teamMonitor) sendDiscovery(client mqtt.Client) {
+	availability := m.topics.availability()
+	publishDiscovery(client, m.topics, newDevice(m.topics, "Team"), availability, diagnosticEntities(m.topics))
+	for _, member := range m.Members() {
+		publishDiscovery(client, member.topics, member.device, availability, presenceEntities(member.topics))
+	}
+}
+
+// Run polls the presences every interval and publishes them per member when
+// they change or the heartbeat is due. Group memberships are refreshed every
+// teamRefreshInterval. While Graph throttles the bot, polling pauses and the
+// last published presences are kept. Run returns when ctx is done.
+func (m *teamMonitor) Run(ctx context.Context, connection *mqttConnection, heartbeat time.Duration) {
+	lastPresences := map[string]Presence{}
+	lastPublished := map[string]time.Time{}
+	var lastVersion Version
+	var lastGraphStatus GraphStatus
+	var lastVersionPublished time.Time
+	lastResolved := time.Now()
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(lastResolved) >= teamRefreshInterval {
+			lastResolved = time.Now()
+			previous := m.Members()
+			if err := m.resolve(ctx); err != nil {
+				log.Println("Error refreshing team members:", err)
+			} else {
+				for _, member := range m.removeMembers(connection, previous) {
+					delete(lastPresences, member.Id)
+					delete(lastPublished, member.Id)
+				}
+				if connection.IsConnected() {
+					m.sendDiscovery(connection.client)
+				}
+			}
+		}
+
+		v := Version{Version: version, Latest: latestVersion}
+		graphStatus := m.throttle.Status()
+		if v != lastVersion || graphStatus != lastGraphStatus || time.Since(lastVersionPublished) >= heartbeat {
+			versionJson, _ := json.Marshal(v)
+			connection.Publish(m.topics.Version(), 0, true, versionJson)
+			graphJson, _ := json.Marshal(graphStatus)
+			connection.Publish(m.topics.Graph(), 0, true, graphJson)
+			lastVersion = v
+			lastGraphStatus = graphStatus
+			lastVersionPublished = time.Now()
+		}
+
+		// the last published presences are repeated as heartbeat while
+		// Graph throttles the bot
+		presences := lastPresences
+		if !m.throttle.Active() {
+			requestCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+			fetched, err := m.presences(requestCtx)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil && !m.throttle.Observe(err) {
+				log.Println("Error requesting team presences:", err)
+				continue
+			}
+			if err == nil {
+				presences = fetched
+			}
+		}
+		for _, member := range m.Members() {
+			presence, ok := presences[member.Id]
+			if !ok {
+				presence = Presence{Availability: "unknown", Activity: "unknown"}
+			}
+			last, known := lastPresences[member.Id]
+			if known && presence.Equal(last) && time.Since(lastPublished[member.Id]) < heartbeat {
+				continue
+			}
+			presenceJson, _ := json.Marshal(presence)
+			connection.Publish(member.topics.Presence(), 0, true, string(presenceJson))
+			lastPresences[member.Id] = presence
+			lastPublished[member.Id] = time.Now()
+		}
+	}
+}
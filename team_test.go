@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rindula/msteams-presence-bot-go/token"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestTeamMonitor(t *testing.T) {
+	// the next link may point to another host than graphBaseURL
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1.0/groups/lab/transitiveMembers/microsoft.graph.user" || r.URL.Query().Get("page") != "2" {
+			t.Errorf("unexpected next link request %s", r.URL)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"value": []User{{Id: "3", UserPrincipalName: "max@contoso.com"}}})
+	}))
+	defer next.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer app" {
+			t.Errorf("authorization = %q", r.Header.Get("Authorization"))
+		}
+		switch {
+		case r.URL.Path == "/users/jane.doe@contoso.com":
+			json.NewEncoder(w).Encode(User{Id: "1", DisplayName: "Jane", UserPrincipalName: "jane.doe@contoso.com"})
+		case r.URL.Path == "/groups/lab/transitiveMembers/microsoft.graph.user":
+			json.NewEncoder(w).Encode(map[string]any{
+				"value":           []User{{Id: "1", UserPrincipalName: "jane.doe@contoso.com"}, {Id: "2", UserPrincipalName: "john@contoso.com"}},
+				"@odata.nextLink": next.URL + "/v1.0/groups/lab/transitiveMembers/microsoft.graph.user?page=2",
+			})
+		case r.URL.Path == "/communications/getPresencesByUserId":
+			var request struct {
+				Ids []string `json:"ids"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			if !reflect.DeepEqual(request.Ids, []string{"1", "2", "3"}) {
+				t.Errorf("ids = %v", request.Ids)
+			}
+			json.NewEncoder(w).Encode(map[string]any{"value": []map[string]string{
+				{"id": "1", "availability": "Busy", "activity": "InACall"},
+				{"id": "3", "availability": "Away", "activity": "Away"},
+			}})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	previousBaseURL := graphBaseURL
+	graphBaseURL = server.URL
+	defer func() { graphBaseURL = previousBaseURL }()
+
+	config := PresenceConfig{Users: "jane.doe@contoso.com", Groups: "lab"}
+	monitor := teamMonitorFromConfig(server.Client(), Topics{Base: "msteams/team", DiscoveryPrefix: "homeassistant", NodeID: "team"}, config)
+	monitor.getToken = func(context.Context) (token.Token, error) { return token.Token{Token: "app"}, nil }
+	if monitor.interval != defaultTeamPollInterval {
+		t.Fatalf("interval = %s", monitor.interval)
+	}
+	if err := monitor.resolve(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	members := monitor.Members()
+	if len(members) != 3 {
+		t.Fatalf("members = %+v", members)
+	}
+	if members[0].device.Name != "Teams Status Jane" || members[1].topics.Presence() != "msteams/team/john_contoso_com/presence" {
+		t.Fatalf("members = %+v", members)
+	}
+	if got := members[2].topics.UniqueID("availability"); got != "teams_team_max_contoso_com_availability" {
+		t.Fatalf("unique ID = %s", got)
+	}
+
+	presences, err := monitor.presences(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if presences["1"].Activity != "InACall" || presences["3"].Availability != "Away" || len(presences) != 2 {
+		t.Fatalf("presences = %+v", presences)
+	}
+}
+
+func TestTeamMonitorRemovesMembers(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.stop()
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", b.address))
+	opts.SetClientID("test-bot")
+	connection := newMQTTConnection(opts, testTopics, nil)
+	connection.Connect()
+	defer connection.Close()
+
+	monitor := teamMonitorFromConfig(http.DefaultClient, testTopics, PresenceConfig{Groups: "lab"})
+	member := func(user User) teamMember {
+		return teamMember{User: user, topics: monitor.memberTopics(user)}
+	}
+	jane := member(User{Id: "1", UserPrincipalName: "jane@contoso.com"})
+	john := member(User{Id: "2", UserPrincipalName: "john@contoso.com"})
+	monitor.members = []teamMember{jane}
+
+	removed := monitor.removeMembers(connection, []teamMember{jane, john})
+	if len(removed) != 1 || removed[0].Id != "2" {
+		t.Fatalf("removed = %+v", removed)
+	}
+	for _, entity := range presenceEntities(john.topics) {
+		b.waitFor(john.topics.Discovery(entity.component, entity.objectID), "")
+	}
+	b.waitFor(john.topics.Presence(), "")
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if messages := b.messages[jane.topics.Presence()]; len(messages) != 0 {
+		t.Fatalf("remaining member was cleared: %v", messages)
+	}
+}
+
+func TestTeamPollInterval(t *testing.T) {
+	if got := teamPollInterval("1m"); got != time.Minute {
+		t.Fatalf("interval = %s", got)
+	}
+	if got := teamPollInterval("10ms"); got != defaultTeamPollInterval {
+		t.Fatalf("interval = %s, want the default for a too short interval", got)
+	}
+}
+
+func TestTeamMonitorFromConfigIsOptional(t *testing.T) {
+	if monitor := teamMonitorFromConfig(http.DefaultClient, Topics{}, PresenceConfig{Groups: " , "}); monitor != nil {
+		t.Fatalf("monitor = %+v", monitor)
+	}
+}
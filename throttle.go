@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRetryAfter is used when Graph throttles without a Retry-After header.
+const defaultRetryAfter = 30 * time.Second
+
+// parseRetryAfter reads a Retry-After header given in seconds or as HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return defaultRetryAfter
+}
+
+type GraphStatus struct {
+	Throttled bool      `json:"throttled"`
+	RetryAt   time.Time `json:"retry_at,omitzero"`
+}
+
+// graphThrottle remembers until when Graph asked the bot to back off.
+type graphThrottle struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	until time.Time
+}
+
+func newGraphThrottle() *graphThrottle {
+	return &graphThrottle{now: time.Now}
+}
+
+// Observe records the back off requested by err and reports whether err was
+// a throttling response.
+func (t *graphThrottle) Observe(err error) bool {
+	var graphErr *graphError
+	if !errors.As(err, &graphErr) || graphErr.RetryAfter <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until := t.now().Add(graphErr.RetryAfter)
+	if until.After(t.until) {
+		t.until = until
+	}
+	log.Printf("Graph is throttling requests (HTTP %d), backing off until %s\n", graphErr.StatusCode, t.until.Format(time.RFC3339))
+	return true
+}
+
+// Active reports whether the bot has to wait before calling Graph again.
+func (t *graphThrottle) Active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.now().Before(t.until)
+}
+
+func (t *graphThrottle) Status() GraphStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.now().Before(t.until) {
+		return GraphStatus{}
+	}
+	return GraphStatus{Throttled: true, RetryAt: t.until.UTC()}
+}
+
+// presencePoller requests the presence from Graph and keeps reporting the last
+// known presence while Graph throttles the bot.
+type presencePoller struct {
+	fetch    func() (Presence, error)
+	throttle *graphThrottle
+
+	mu   sync.Mutex
+	last Presence
+}
+
+func newPresencePoller(fetch func() (Presence, error), throttle *graphThrottle) *presencePoller {
+	return &presencePoller{
+		fetch:    fetch,
+		throttle: throttle,
+		last:     Presence{Availability: "unknown", Activity: "unknown"},
+	}
+}
+
+func (p *presencePoller) Current() Presence {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.throttle.Active() {
+		return p.last
+	}
+	presence, err := p.fetch()
+	if p.throttle.Observe(err) {
+		return p.last
+	}
+	if err != nil {
+		log.Println("Error requesting presence", err)
+	}
+	p.last = presence
+	return presence
+}
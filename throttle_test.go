@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"120", 2 * time.Minute},
+		{" 5 ", 5 * time.Second},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), defaultRetryAfter},
+		{"", defaultRetryAfter},
+		{"0", defaultRetryAfter},
+		{"soon", defaultRetryAfter},
+	}
+	for _, test := range tests {
+		if got := parseRetryAfter(test.value, now); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestPresencePollerBacksOffWhileThrottled(t *testing.T) {
+	var throttled atomic.Bool
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/me/presence" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		if throttled.Load() {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": "TooManyRequests", "message": "Too many requests"}})
+			return
+		}
+		json.NewEncoder(w).Encode(Presence{Availability: "Busy", Activity: "InACall"})
+	}))
+	defer server.Close()
+	previousBaseURL := graphBaseURL
+	graphBaseURL = server.URL
+	defer func() { graphBaseURL = previousBaseURL }()
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	throttle := newGraphThrottle()
+	throttle.now = func() time.Time { return now }
+	poller := newPresencePoller(func() (Presence, error) {
+		return getPresence(context.Background(), server.Client(), "access")
+	}, throttle)
+
+	if presence := poller.Current(); presence.Availability != "Busy" {
+		t.Fatalf("presence = %+v", presence)
+	}
+
+	throttled.Store(true)
+	if presence := poller.Current(); presence.Availability != "Busy" || presence.Activity != "InACall" {
+		t.Fatalf("presence while throttled = %+v", presence)
+	}
+	status := throttle.Status()
+	if !status.Throttled || !status.RetryAt.Equal(now.Add(2*time.Minute)) {
+		t.Fatalf("status = %+v", status)
+	}
+
+	// no requests are sent until Retry-After has passed
+	for range 5 {
+		poller.Current()
+	}
+	if got := requests.Load(); got != 2 {
+		t.Fatalf("requests = %d, want 2", got)
+	}
+
+	throttled.Store(false)
+	now = now.Add(2 * time.Minute)
+	if status := throttle.Status(); status.Throttled {
+		t.Fatalf("status after back off = %+v", status)
+	}
+	if presence := poller.Current(); presence.Availability != "Busy" || requests.Load() != 3 {
+		t.Fatalf("presence = %+v after %d requests", presence, requests.Load())
+	}
+}
+
+func TestPresencePollerReportsUnknownOnOtherErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	previousBaseURL := graphBaseURL
+	graphBaseURL = server.URL
+	defer func() { graphBaseURL = previousBaseURL }()
+
+	throttle := newGraphThrottle()
+	poller := newPresencePoller(func() (Presence, error) {
+		return getPresence(context.Background(), server.Client(), "access")
+	}, throttle)
+	if presence := poller.Current(); presence.Availability != "unknown" || throttle.Active() {
+		t.Fatalf("presence = %+v", presence)
+	}
+}
@@ -0,0 +1,49 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// appScope requests all application permissions granted to the app.
+var appScope string = "https://graph.microsoft.com/.default"
+
+var appToken Token
+var appTokenMu sync.Mutex
+
+// GetAppToken returns an app-only token for Microsoft Graph obtained with the
+// client credentials flow. The token is kept in memory and requested again
+// shortly before it expires.
+func GetAppToken(ctx context.Context) (Token, error) {
+	appTokenMu.Lock()
+	defer appTokenMu.Unlock()
+	if appToken.Token != "" && appToken.ValidUntil > time.Now().Add(time.Minute).Unix() {
+		return appToken, nil
+	}
+
+	clientSecret := get(settings.ClientSecret)
+	if clientSecret == "" {
+		return Token{}, fmt.Errorf("CLIENT_SECRET is required for app-only access")
+	}
+	tenantId := get(settings.Tenant)
+	if tenantId == "" || tenantId == "common" || tenantId == "organizations" {
+		return Token{}, fmt.Errorf("AUTH_TENANT must be the tenant ID for app-only access")
+	}
+	payloadData := url.Values{}
+	payloadData.Set("grant_type", "client_credentials")
+	payloadData.Set("client_id", get(settings.ClientID))
+	payloadData.Set("client_secret", clientSecret)
+	payloadData.Set("scope", appScope)
+	var body tokenResponse
+	if err := postForm(ctx, httpClient, endpoint("token"), payloadData, &body); err != nil {
+		return Token{}, fmt.Errorf("request app token: %w", err)
+	}
+	if body.AccessToken == "" {
+		return Token{}, fmt.Errorf("app token response contains no access token")
+	}
+	appToken = Token{Token: body.AccessToken, ValidUntil: time.Now().Unix() + body.ExpiresIn}
+	return appToken, nil
+}
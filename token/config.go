@@ -0,0 +1,63 @@
+package token
+
+import (
+	"net/http"
+	"time"
+)
+
+// httpClient sends all requests to the identity platform.
+var httpClient *http.Client = http.DefaultClient
+
+// Config selects the identity platform of a national cloud or a local
+// stand-in, the app registration and the token store.
+type Config struct {
+	// AuthorityHost is e.g. https://login.microsoftonline.us for US
+	// Government or https://login.chinacloudapi.cn for China.
+	AuthorityHost string
+	// AppScope is the scope of app-only tokens, the Graph resource followed
+	// by /.default.
+	AppScope   string
+	HTTPClient *http.Client
+
+	// ClientID, Tenant, Scopes and ClientSecret are called for every
+	// request.
+	ClientID     func() string
+	Tenant       func() string
+	Scopes       func() string
+	ClientSecret func() string
+	// LoginMode selects the interactive login: device (default) or browser.
+	LoginMode string
+	// RedirectPort is the loopback port of the browser login, a free port
+	// if empty.
+	RedirectPort string
+
+	// Store and RefreshMargin configure the manager returned by Default.
+	Store         StoreConfig
+	RefreshMargin time.Duration
+}
+
+// settings is the configuration passed to Configure.
+var settings Config
+
+// Configure has to be called before the first token is requested. Empty
+// endpoints keep the current values.
+func Configure(config Config) {
+	if config.AuthorityHost != "" {
+		authorityHost = config.AuthorityHost
+	}
+	if config.AppScope != "" {
+		appScope = config.AppScope
+	}
+	if config.HTTPClient != nil {
+		httpClient = config.HTTPClient
+	}
+	settings = config
+}
+
+// get returns the current value of a setting, "" if it is not configured.
+func get(setting func() string) string {
+	if setting == nil {
+		return ""
+	}
+	return setting()
+}
@@ -0,0 +1,144 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInteractionRequired means the user has to sign in again.
+	ErrInteractionRequired = errors.New("interaction required")
+	// ErrInvalidGrant means the refresh token or device code was rejected,
+	// e.g. because it expired or was revoked.
+	ErrInvalidGrant = errors.New("invalid grant")
+	// ErrNetwork means the identity platform could not be reached or
+	// failed temporarily.
+	ErrNetwork = errors.New("network error")
+)
+
+// AuthError is an error response of the Microsoft identity platform.
+type AuthError struct {
+	StatusCode  int
+	Code        string
+	Description string
+	// Codes are the AADSTS error codes, e.g. 70008 for an expired refresh
+	// token.
+	Codes []int
+}
+
+func (e *AuthError) Error() string {
+	message := fmt.Sprintf("identity platform returned HTTP %d: %s", e.StatusCode, e.Code)
+	if e.Description != "" {
+		// the description contains trace and correlation IDs on further lines
+		message += ": " + strings.SplitN(e.Description, "\r\n", 2)[0]
+	}
+	return message
+}
+
+// interactionCodes are AADSTS codes that need the user to sign in again,
+// e.g. for MFA, consent or a password change.
+var interactionCodes = map[int]bool{50055: true, 50058: true, 50076: true, 50079: true, 50173: true, 65001: true, 700084: true}
+
+// Is makes errors.Is match the sentinel errors of the error codes.
+func (e *AuthError) Is(target error) bool {
+	switch target {
+	case ErrInvalidGrant:
+		return e.Code == "invalid_grant" || e.Code == "expired_token" || e.Code == "authorization_declined"
+	case ErrInteractionRequired:
+		if e.Code == "interaction_required" || e.Code == "consent_required" || e.Code == "login_required" {
+			return true
+		}
+		for _, code := range e.Codes {
+			if interactionCodes[code] {
+				return true
+			}
+		}
+	case ErrNetwork:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+	}
+	return false
+}
+
+var aadstsCode = regexp.MustCompile(`AADSTS(\d+)`)
+
+// parseAuthError reads the OAuth error response of the identity platform.
+// The AADSTS codes are taken from the description if the response does not
+// list them.
+func parseAuthError(statusCode int, body []byte) *AuthError {
+	var response struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+		ErrorCodes       []int  `json:"error_codes"`
+	}
+	json.Unmarshal(body, &response)
+	authErr := &AuthError{StatusCode: statusCode, Code: response.Error, Description: response.ErrorDescription, Codes: response.ErrorCodes}
+	if authErr.Code == "" {
+		authErr.Code = http.StatusText(statusCode)
+	}
+	if len(authErr.Codes) == 0 {
+		for _, match := range aadstsCode.FindAllStringSubmatch(response.ErrorDescription, -1) {
+			if code, err := strconv.Atoi(match[1]); err == nil {
+				authErr.Codes = append(authErr.Codes, code)
+			}
+		}
+	}
+	return authErr
+}
+
+// maxAttempts bounds the requests to the identity platform for one call,
+// retryDelay is doubled after each failed attempt.
+var maxAttempts = 3
+var retryDelay = time.Second
+
+// postForm posts a form to the identity platform and decodes the JSON reply
+// into out. Network errors and temporary failures are retried up to
+// maxAttempts times; error responses are returned as *AuthError.
+func postForm(ctx context.Context, client *http.Client, endpoint string, values url.Values, out any) error {
+	delay := retryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = postFormOnce(ctx, client, endpoint, values, out)
+		if err == nil || !errors.Is(err, ErrNetwork) || attempt >= maxAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func postFormOnce(ctx context.Context, client *http.Client, endpoint string, values url.Values, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return fmt.Errorf("%w: read response: %w", ErrNetwork, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return parseAuthError(resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("decode response of %s: %w", endpoint, err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useFakeAuthority points the token package at a fake identity platform.
+func useFakeAuthority(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	previousHost, previousDelay, previousSettings := authorityHost, retryDelay, settings
+	authorityHost = server.URL
+	retryDelay = time.Millisecond
+	settings = Config{Tenant: fixed("contoso"), ClientID: fixed("client"), Scopes: fixed("user.read offline_access")}
+	t.Cleanup(func() { authorityHost, retryDelay, settings = previousHost, previousDelay, previousSettings })
+}
+
+// fixed returns a setting that always has value.
+func fixed(value string) func() string {
+	return func() string { return value }
+}
+
+func TestParseAuthError(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		target error
+		codes  []int
+	}{
+		{400, `{"error":"invalid_grant","error_description":"AADSTS70008: The provided authorization code or refresh token has expired.\r\nTrace ID: 1","error_codes":[70008]}`, ErrInvalidGrant, []int{70008}},
+		{400, `{"error":"invalid_grant","error_description":"AADSTS50076: Due to a configuration change made by your administrator, you must use multi-factor authentication."}`, ErrInteractionRequired, []int{50076}},
+		{400, `{"error":"interaction_required"}`, ErrInteractionRequired, nil},
+		{503, `<html>Service Unavailable</html>`, ErrNetwork, nil},
+	}
+	for _, test := range tests {
+		err := parseAuthError(test.status, []byte(test.body))
+		if !errors.Is(err, test.target) {
+			t.Errorf("parseAuthError(%s) = %v, want %v", test.body, err, test.target)
+		}
+		if fmt.Sprint(err.Codes) != fmt.Sprint(test.codes) {
+			t.Errorf("parseAuthError(%s) codes = %v, want %v", test.body, err.Codes, test.codes)
+		}
+	}
+	if err := parseAuthError(400, []byte(`{"error":"invalid_client"}`)); errors.Is(err, ErrInvalidGrant) || errors.Is(err, ErrNetwork) {
+		t.Errorf("invalid_client matches %v", err)
+	}
+}
+
+func TestPostFormRetriesTemporaryFailures(t *testing.T) {
+	var requests atomic.Int32
+	useFakeAuthority(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	var response tokenResponse
+	err := postForm(t.Context(), http.DefaultClient, endpoint("token"), url.Values{}, &response)
+	if !errors.Is(err, ErrNetwork) || requests.Load() != int32(maxAttempts) {
+		t.Fatalf("postForm() = %v after %d requests", err, requests.Load())
+	}
+
+	// rejected grants are not retried
+	requests.Store(0)
+	useFakeAuthority(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_grant"}`)
+	})
+	if _, err := requestToken(t.Context(), "revoked"); !errors.Is(err, ErrInvalidGrant) || requests.Load() != 1 {
+		t.Fatalf("requestToken() = %v after %d requests", err, requests.Load())
+	}
+}
+
+func TestMalformedResponsesDoNotPanic(t *testing.T) {
+	for _, body := range []string{`not json`, `{}`, `{"access_token":42}`, `{"access_token":"access"}`} {
+		useFakeAuthority(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		})
+		if token, err := requestToken(t.Context(), "refresh"); err == nil {
+			t.Errorf("requestToken() with %s = %+v", body, token)
+		}
+		if _, err := requestRefreshToken(t.Context()); err == nil {
+			t.Errorf("requestRefreshToken() with %s succeeded", body)
+		}
+	}
+}
+
+func TestRefreshTokenSignsInAgainAfterInvalidGrant(t *testing.T) {
+	var polls atomic.Int32
+	useFakeAuthority(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/contoso/oauth2/v2.0/devicecode":
+			fmt.Fprint(w, `{"device_code":"device","user_code":"ABC","verification_uri":"https://microsoft.com/devicelogin","expires_in":900,"interval":0}`)
+		case r.Form.Get("grant_type") == "refresh_token":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_codes":[70008]}`)
+		case r.Form.Get("device_code") == "device" && polls.Add(1) < 3:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"authorization_pending"}`)
+		case r.Form.Get("device_code") == "device":
+			fmt.Fprint(w, `{"access_token":"access","refresh_token":"refresh","expires_in":3600}`)
+		default:
+			t.Errorf("unexpected request %s %v", r.URL, r.Form)
+		}
+	})
+	token, err := refreshToken(t.Context(), Token{RefreshToken: "expired"}, interactiveLogin)
+	if err != nil || token.Token != "access" || token.RefreshToken != "refresh" || polls.Load() != 3 {
+		t.Fatalf("refreshToken() = %+v, %v after %d polls", token, err, polls.Load())
+	}
+}
+
+func TestDeviceCodeDeclined(t *testing.T) {
+	useFakeAuthority(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/contoso/oauth2/v2.0/devicecode" {
+			fmt.Fprint(w, `{"device_code":"device","user_code":"ABC","verification_uri":"https://microsoft.com/devicelogin","expires_in":900,"interval":0}`)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"authorization_declined"}`)
+	})
+	if _, err := requestRefreshToken(t.Context()); !errors.Is(err, ErrInvalidGrant) {
+		t.Fatalf("requestRefreshToken() error = %v", err)
+	}
+}
+
+func TestDeviceCodeExpired(t *testing.T) {
+	useFakeAuthority(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/contoso/oauth2/v2.0/devicecode" {
+			fmt.Fprint(w, `{"device_code":"device","user_code":"ABC","verification_uri":"https://microsoft.com/devicelogin","expires_in":900,"interval":0}`)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"expired_token"}`)
+	})
+	var states []LoginState
+	previousHandlers := loginStateHandlers
+	loginStateHandlers = []func(LoginState){func(state LoginState) { states = append(states, state) }}
+	defer func() { loginStateHandlers = previousHandlers }()
+
+	if _, err := requestRefreshToken(t.Context()); err == nil {
+		t.Fatal("requestRefreshToken() succeeded")
+	}
+	if len(states) != 2 || !states[0].Pending || states[1].Pending || states[1].Outcome != LoginExpired {
+		t.Fatalf("login states = %+v", states)
+	}
+}
@@ -0,0 +1,269 @@
+package token
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rindula/msteams-presence-bot-go/atomicfile"
+)
+
+// keyFile is the name of the key generated next to the token file if
+// neither a passphrase nor a key file is configured.
+var keyFile string = "token.key"
+
+// FileStore keeps the token encrypted in a local file.
+type FileStore struct {
+	Path string
+	// Passphrase returns the passphrase the key is derived from. Without a
+	// passphrase the key is read from KeyFile.
+	Passphrase func() string
+	KeyFile    string
+	// GenerateKey creates KeyFile with a random key if it does not exist.
+	GenerateKey bool
+}
+
+// NewFileStore returns a store for path with a key generated next to it.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path, KeyFile: filepath.Join(filepath.Dir(path), filepath.Base(keyFile)), GenerateKey: true}
+}
+
+// encryptedPrefix marks token files encrypted with AES-GCM and a key derived
+// with PBKDF2, keyFilePrefix those with a key derived from a key file with
+// HKDF. Older versions wrote the token as plain base64 encoded gob and used
+// PBKDF2 for key files as well.
+const (
+	encryptedPrefix = "enc:v1:"
+	keyFilePrefix   = "enc:v2:"
+)
+
+const (
+	saltSize         = 16
+	keySize          = 32
+	pbkdf2Iterations = 600000
+)
+
+// tokenSecret is the passphrase or the content of the key file protecting
+// the token file.
+type tokenSecret struct {
+	value      []byte
+	passphrase bool
+}
+
+// prefix returns the format the token is written in with this secret.
+func (s tokenSecret) prefix() string {
+	if s.passphrase {
+		return encryptedPrefix
+	}
+	return keyFilePrefix
+}
+
+// passphraseKey caches the key last derived from a passphrase. Save reuses
+// its salt, so the passphrase is stretched once per start and not on every
+// token refresh.
+var passphraseKey struct {
+	sync.Mutex
+	id   [sha256.Size]byte
+	salt []byte
+	key  []byte
+}
+
+// secret returns the passphrase or the content of the key file the token
+// key is derived from.
+func (s *FileStore) secret() (tokenSecret, error) {
+	if passphrase := get(s.Passphrase); passphrase != "" {
+		return tokenSecret{value: []byte(passphrase), passphrase: true}, nil
+	}
+	secret, err := os.ReadFile(s.KeyFile)
+	if errors.Is(err, os.ErrNotExist) && s.GenerateKey {
+		secret = make([]byte, keySize)
+		if _, err := rand.Read(secret); err != nil {
+			return tokenSecret{}, fmt.Errorf("generate token key: %w", err)
+		}
+		if err := atomicfile.WriteFile(s.KeyFile, secret); err != nil {
+			return tokenSecret{}, fmt.Errorf("save token key: %w", err)
+		}
+		log.Println("Generated token key", s.KeyFile)
+		return tokenSecret{value: secret}, nil
+	}
+	if err != nil {
+		return tokenSecret{}, fmt.Errorf("read token key: %w", err)
+	}
+	if len(bytes.TrimSpace(secret)) == 0 {
+		return tokenSecret{}, fmt.Errorf("token key file %s is empty", s.KeyFile)
+	}
+	return tokenSecret{value: secret}, nil
+}
+
+// newSalt returns the salt of the cached passphrase key, or a random salt.
+func (s tokenSecret) newSalt() ([]byte, error) {
+	if s.passphrase {
+		passphraseKey.Lock()
+		defer passphraseKey.Unlock()
+		if passphraseKey.key != nil && passphraseKey.id == sha256.Sum256(s.value) {
+			return passphraseKey.salt, nil
+		}
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// deriveKey returns the key of a token file in the format prefix. A
+// passphrase is stretched with PBKDF2, a key file is random already and only
+// bound to the salt with HKDF.
+func deriveKey(prefix string, secret tokenSecret, salt []byte) ([]byte, error) {
+	if prefix == keyFilePrefix {
+		return hkdf.Key(sha256.New, secret.value, salt, "token.data", keySize)
+	}
+	id := sha256.Sum256(secret.value)
+	passphraseKey.Lock()
+	defer passphraseKey.Unlock()
+	if passphraseKey.key != nil && passphraseKey.id == id && bytes.Equal(passphraseKey.salt, salt) {
+		return passphraseKey.key, nil
+	}
+	key, err := pbkdf2.Key(sha256.New, string(secret.value), salt, pbkdf2Iterations, keySize)
+	if err != nil {
+		return nil, err
+	}
+	// a key file of an older version is read with PBKDF2 once to upgrade
+	// the token file, it must not evict the passphrase
+	if secret.passphrase {
+		passphraseKey.id, passphraseKey.salt, passphraseKey.key = id, bytes.Clone(salt), key
+	}
+	return key, nil
+}
+
+func newGCM(prefix string, secret tokenSecret, salt []byte) (cipher.AEAD, error) {
+	key, err := deriveKey(prefix, secret, salt)
+	if err != nil {
+		return nil, fmt.Errorf("derive token key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptToken encodes the token and encrypts it with AES-GCM. The result
+// contains the salt, the nonce and the ciphertext.
+func encryptToken(token Token, secret tokenSecret) ([]byte, error) {
+	var plaintext bytes.Buffer
+	if err := gob.NewEncoder(&plaintext).Encode(token); err != nil {
+		return nil, fmt.Errorf("encode token: %w", err)
+	}
+	salt, err := secret.newSalt()
+	if err != nil {
+		return nil, err
+	}
+	prefix := secret.prefix()
+	gcm, err := newGCM(prefix, secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(append(bytes.Clone(salt), nonce...), nonce, plaintext.Bytes(), []byte(prefix))
+	return []byte(prefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// decryptToken reverses encryptToken. Plain base64 encoded gob and key files
+// with PBKDF2 as written by older versions are accepted as well; outdated
+// reports whether the token should be encrypted again.
+func decryptToken(data []byte, secret tokenSecret) (token Token, outdated bool, err error) {
+	content := strings.TrimSpace(string(data))
+	prefix := ""
+	for _, p := range []string{encryptedPrefix, keyFilePrefix} {
+		if strings.HasPrefix(content, p) {
+			prefix = p
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(content, prefix))
+	if err != nil {
+		return Token{}, false, fmt.Errorf("decode token file: %w", err)
+	}
+	if prefix != "" {
+		gcm, err := newGCM(prefix, secret, decoded[:min(saltSize, len(decoded))])
+		if err != nil {
+			return Token{}, false, err
+		}
+		if len(decoded) < saltSize+gcm.NonceSize() {
+			return Token{}, false, fmt.Errorf("token file is truncated")
+		}
+		nonce := decoded[saltSize : saltSize+gcm.NonceSize()]
+		decoded, err = gcm.Open(nil, nonce, decoded[saltSize+gcm.NonceSize():], []byte(prefix))
+		if err != nil {
+			return Token{}, false, fmt.Errorf("decrypt token file, wrong passphrase or key file? %w", err)
+		}
+	}
+	if err := gob.NewDecoder(bytes.NewReader(decoded)).Decode(&token); err != nil {
+		return Token{}, false, fmt.Errorf("decode token: %w", err)
+	}
+	return token, prefix != secret.prefix(), nil
+}
+
+// Save encrypts the token and writes it to the file.
+func (s *FileStore) Save(token Token) error {
+	secret, err := s.secret()
+	if err != nil {
+		return err
+	}
+	data, err := encryptToken(token, secret)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.Path, data)
+}
+
+// Load reads the file. A plaintext file or an older format is encrypted in
+// place.
+func (s *FileStore) Load() (Token, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Token{}, ErrNoToken
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	secret, err := s.secret()
+	if err != nil {
+		return Token{}, err
+	}
+	token, outdated, err := decryptToken(data, secret)
+	if err != nil {
+		return Token{}, err
+	}
+	if outdated {
+		log.Println("Encrypting token file", s.Path, "in the current format")
+		if err := s.Save(token); err != nil {
+			log.Println("[ekmgrt] Error encrypting token file:", err)
+		}
+	}
+	return token, nil
+}
+
+// Delete removes the token file. The key file is kept.
+func (s *FileStore) Delete() error {
+	if err := os.Remove(s.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package token
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestFileStore(t *testing.T) *FileStore {
+	t.Helper()
+	store := NewFileStore(filepath.Join(t.TempDir(), "token.data"))
+	if store.KeyFile != filepath.Join(filepath.Dir(store.Path), "token.key") {
+		t.Fatalf("key file = %s", store.KeyFile)
+	}
+	return store
+}
+
+// salt returns the salt of an encrypted token file.
+func salt(t *testing.T, data []byte) string {
+	t.Helper()
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(string(data), encryptedPrefix))
+	if err != nil || len(decoded) < saltSize {
+		t.Fatalf("token file %q: %v", data, err)
+	}
+	return string(decoded[:saltSize])
+}
+
+func TestWriteTokenEncrypts(t *testing.T) {
+	store := newTestFileStore(t)
+	store.Passphrase = fixed("correct horse battery staple")
+	want := Token{Token: "access", ValidUntil: 42, RefreshToken: "refresh-secret"}
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), encryptedPrefix) || bytes.Contains(data, []byte("refresh-secret")) {
+		t.Fatalf("token file is not encrypted: %q", data)
+	}
+	info, err := os.Stat(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("mode = %v", info.Mode())
+	}
+	if _, err := os.Stat(store.KeyFile); !os.IsNotExist(err) {
+		t.Fatalf("key file was generated although a passphrase is set: %v", err)
+	}
+
+	got, err := store.Load()
+	if err != nil || got != want {
+		t.Fatalf("Load() = %+v, %v", got, err)
+	}
+
+	// the key derived from the passphrase is reused for the next token
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	again, err := os.ReadFile(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if salt(t, again) != salt(t, data) {
+		t.Fatal("Save() derived a new key from the same passphrase")
+	}
+
+	store.Passphrase = fixed("wrong")
+	if _, err := store.Load(); err == nil {
+		t.Fatal("Load() with the wrong passphrase succeeded")
+	}
+}
+
+func TestReadTokenMigratesPlaintext(t *testing.T) {
+	store := newTestFileStore(t)
+	want := Token{Token: "access", ValidUntil: 42, RefreshToken: "refresh"}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(store.Path, []byte(base64.StdEncoding.EncodeToString(b.Bytes())), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Load()
+	if err != nil || got != want {
+		t.Fatalf("Load() = %+v, %v", got, err)
+	}
+	data, err := os.ReadFile(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), keyFilePrefix) {
+		t.Fatalf("token file was not migrated: %q", data)
+	}
+	if info, err := os.Stat(store.KeyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("generated key file: %v, %v", info, err)
+	}
+	if got, err := store.Load(); err != nil || got != want {
+		t.Fatalf("Load() after migration = %+v, %v", got, err)
+	}
+}
+
+func TestTokenKeyFile(t *testing.T) {
+	store := newTestFileStore(t)
+	path := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(path, []byte("key file content\n"), 0o600)
+	store.KeyFile, store.GenerateKey = path, false
+	if err := store.Save(Token{Token: "access"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Load(); err != nil || got.Token != "access" {
+		t.Fatalf("Load() = %+v, %v", got, err)
+	}
+	if data, _ := os.ReadFile(store.Path); !strings.HasPrefix(string(data), keyFilePrefix) {
+		t.Fatalf("token file = %q, want the key file format", data)
+	}
+
+	// older versions derived the key from a key file with PBKDF2
+	old, err := encryptToken(Token{Token: "old"}, tokenSecret{value: []byte("key file content\n"), passphrase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(store.Path, old, 0o600)
+	if got, err := store.Load(); err != nil || got.Token != "old" {
+		t.Fatalf("Load() of an older token file = %+v, %v", got, err)
+	}
+	if data, _ := os.ReadFile(store.Path); !strings.HasPrefix(string(data), keyFilePrefix) {
+		t.Fatalf("older token file was not migrated: %q", data)
+	}
+
+	store.KeyFile = filepath.Join(t.TempDir(), "missing")
+	if _, err := store.Load(); err == nil {
+		t.Fatal("Load() with a missing key file succeeded")
+	}
+}
+
+func TestFileStoreWithoutToken(t *testing.T) {
+	store := newTestFileStore(t)
+	if _, err := store.Load(); err != ErrNoToken {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if err := store.Delete(); err != nil {
+		t.Fatal(err)
+	}
+}
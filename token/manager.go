@@ -0,0 +1,213 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// expirySkew is the remaining lifetime below which Token refreshes before
+// returning, so a token does not expire while a request is in flight.
+const expirySkew = 30 * time.Second
+
+const refreshRetryInterval = 30 * time.Second
+
+// Manager caches the token of the signed-in user in memory and refreshes it
+// before it expires. It is safe for concurrent use; concurrent refreshes are
+// serialised.
+type Manager struct {
+	store   TokenStore
+	margin  time.Duration
+	refresh func(ctx context.Context, old Token) (Token, error)
+	login   func(ctx context.Context) (Token, error)
+	now     func() time.Time
+
+	// lock is held during refreshes, a channel so waiting honours ctx
+	lock   chan struct{}
+	mu     sync.Mutex
+	cached *Token
+	// lifetime is the lifetime of the last refreshed token, 0 until the
+	// first refresh
+	lifetime time.Duration
+}
+
+func NewManager(store TokenStore, margin time.Duration) *Manager {
+	m := &Manager{
+		store:  store,
+		margin: margin,
+		login:  interactiveLogin,
+		now:    time.Now,
+		lock:   make(chan struct{}, 1),
+	}
+	m.refresh = func(ctx context.Context, old Token) (Token, error) {
+		return refreshToken(ctx, old, m.login)
+	}
+	return m
+}
+
+// DisableLogin makes the manager return ErrInteractionRequired instead of
+// signing in interactively, e.g. for commands nobody watches.
+func (m *Manager) DisableLogin() {
+	m.login = func(context.Context) (Token, error) {
+		return Token{}, fmt.Errorf("no valid token stored: %w", ErrInteractionRequired)
+	}
+}
+
+var defaultManager struct {
+	sync.Once
+	*Manager
+	err error
+}
+
+// Default returns the manager of the signed-in user. It uses the store and
+// the refresh margin passed to Configure.
+func Default() (*Manager, error) {
+	defaultManager.Do(func() {
+		store, err := currentStore()
+		if err != nil {
+			defaultManager.err = fmt.Errorf("invalid token store: %w", err)
+			return
+		}
+		defaultManager.Manager = NewManager(store, settings.RefreshMargin)
+	})
+	return defaultManager.Manager, defaultManager.err
+}
+
+// refreshToken requests a new access token with the refresh token of old.
+// The user signs in again with login if old has no refresh token or it was
+// rejected.
+func refreshToken(ctx context.Context, old Token, login func(ctx context.Context) (Token, error)) (Token, error) {
+	if old.RefreshToken != "" {
+		token, err := requestToken(ctx, old.RefreshToken)
+		if !errors.Is(err, ErrInvalidGrant) && !errors.Is(err, ErrInteractionRequired) {
+			return token, err
+		}
+		log.Println("Refresh token was rejected, signing in again:", err)
+	}
+	// the login waits for the user until ctx is done, callers pass a context
+	// without the deadline of a single request
+	return login(ctx)
+}
+
+func (m *Manager) expiresWithin(token *Token, d time.Duration) bool {
+	return token == nil || time.Unix(token.ValidUntil, 0).Sub(m.now()) < d
+}
+
+func (m *Manager) current() *Token {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cached
+}
+
+// Token returns a usable access token. It is read from the store on first
+// use and refreshed if it expires within expirySkew.
+func (m *Manager) Token(ctx context.Context) (Token, error) {
+	if token := m.current(); !m.expiresWithin(token, expirySkew) {
+		return *token, nil
+	}
+	return m.renew(ctx, expirySkew)
+}
+
+// renew refreshes the token unless it stays valid for longer than d. A
+// refresh of another caller is awaited and its result used.
+func (m *Manager) renew(ctx context.Context, d time.Duration) (Token, error) {
+	select {
+	case m.lock <- struct{}{}:
+	case <-ctx.Done():
+		return Token{}, ctx.Err()
+	}
+	defer func() { <-m.lock }()
+
+	token := m.current()
+	if token == nil {
+		stored, err := m.store.Load()
+		if err != nil && !errors.Is(err, ErrNoToken) {
+			log.Println("[siogre] Error loading token:", err)
+		}
+		if err == nil {
+			token = &stored
+		}
+	}
+	if !m.expiresWithin(token, d) {
+		m.setCached(token)
+		return *token, nil
+	}
+
+	old := Token{}
+	if token != nil {
+		old = *token
+	}
+	refreshed, err := m.refresh(ctx, old)
+	if err != nil {
+		return Token{}, err
+	}
+	if err := m.store.Save(refreshed); err != nil {
+		log.Println("[rhejil] Error saving token:", err)
+	}
+	m.setCached(&refreshed)
+	m.mu.Lock()
+	m.lifetime = time.Unix(refreshed.ValidUntil, 0).Sub(m.now())
+	m.mu.Unlock()
+	return refreshed, nil
+}
+
+// refreshMargin is the margin, capped at half the token lifetime. Otherwise
+// a margin above the lifetime would refresh the token on every pass.
+func (m *Manager) refreshMargin() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lifetime > 0 {
+		return min(m.margin, m.lifetime/2)
+	}
+	return m.margin
+}
+
+func (m *Manager) setCached(token *Token) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cached = token
+}
+
+// Login signs the user in interactively, even if a token is stored, and
+// saves the new token.
+func (m *Manager) Login(ctx context.Context) (Token, error) {
+	select {
+	case m.lock <- struct{}{}:
+	case <-ctx.Done():
+		return Token{}, ctx.Err()
+	}
+	defer func() { <-m.lock }()
+	token, err := m.login(ctx)
+	if err != nil {
+		return Token{}, err
+	}
+	if err := m.store.Save(token); err != nil {
+		return Token{}, fmt.Errorf("save token: %w", err)
+	}
+	m.setCached(&token)
+	return token, nil
+}
+
+// Run refreshes the token in the background margin before it expires until
+// ctx is cancelled.
+func (m *Manager) Run(ctx context.Context) {
+	for {
+		wait := refreshRetryInterval
+		token, err := m.renew(ctx, m.refreshMargin())
+		if err != nil {
+			log.Println("Error refreshing token:", err)
+		} else {
+			wait = max(time.Unix(token.ValidUntil, 0).Sub(m.now())-m.refreshMargin(), time.Second)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
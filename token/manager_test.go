@@ -0,0 +1,151 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestManager(store TokenStore, margin time.Duration, refreshes *atomic.Int32) *Manager {
+	manager := NewManager(store, margin)
+	manager.refresh = func(ctx context.Context, old Token) (Token, error) {
+		n := refreshes.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return Token{Token: "access", ValidUntil: time.Now().Add(time.Hour).Unix(), RefreshToken: old.RefreshToken + "+" + string(rune('0'+n))}, nil
+	}
+	return manager
+}
+
+func TestManagerCachesToken(t *testing.T) {
+	store := &MemoryStore{}
+	valid := Token{Token: "cached", ValidUntil: time.Now().Add(time.Hour).Unix(), RefreshToken: "refresh"}
+	store.Save(valid)
+	var refreshes atomic.Int32
+	manager := newTestManager(store, 5*time.Minute, &refreshes)
+
+	for range 3 {
+		if got, err := manager.Token(t.Context()); err != nil || got != valid {
+			t.Fatalf("Token() = %+v, %v", got, err)
+		}
+	}
+	// the cache is used instead of the store
+	store.Delete()
+	if got, err := manager.Token(t.Context()); err != nil || got != valid {
+		t.Fatalf("Token() = %+v, %v", got, err)
+	}
+	if refreshes.Load() != 0 {
+		t.Fatalf("refreshes = %d", refreshes.Load())
+	}
+}
+
+func TestManagerSerialisesRefreshes(t *testing.T) {
+	store := &MemoryStore{}
+	store.Save(Token{Token: "expired", ValidUntil: time.Now().Add(-time.Minute).Unix(), RefreshToken: "refresh"})
+	var refreshes atomic.Int32
+	manager := newTestManager(store, 5*time.Minute, &refreshes)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			if got, err := manager.Token(t.Context()); err != nil || got.Token != "access" {
+				t.Errorf("Token() = %+v, %v", got, err)
+			}
+		})
+	}
+	wg.Wait()
+	if refreshes.Load() != 1 {
+		t.Fatalf("refreshes = %d, want 1", refreshes.Load())
+	}
+	if saved, _ := store.Load(); saved.RefreshToken != "refresh+1" {
+		t.Fatalf("saved = %+v", saved)
+	}
+}
+
+func TestManagerRefreshesBeforeExpiry(t *testing.T) {
+	store := &MemoryStore{}
+	store.Save(Token{Token: "expiring", ValidUntil: time.Now().Add(2 * time.Minute).Unix(), RefreshToken: "refresh"})
+	var refreshes atomic.Int32
+	manager := newTestManager(store, 5*time.Minute, &refreshes)
+
+	// still valid for callers, but within the margin of the background refresh
+	if got, _ := manager.Token(t.Context()); got.Token != "expiring" {
+		t.Fatalf("Token() = %+v", got)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		manager.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for refreshes.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if refreshes.Load() != 1 {
+		t.Fatalf("refreshes = %d, want 1", refreshes.Load())
+	}
+	if got, _ := manager.Token(t.Context()); got.Token != "access" {
+		t.Fatalf("Token() after refresh = %+v", got)
+	}
+}
+
+func TestManagerCapsMarginAtTokenLifetime(t *testing.T) {
+	store := &MemoryStore{}
+	store.Save(Token{Token: "valid", ValidUntil: time.Now().Add(time.Hour).Unix(), RefreshToken: "refresh"})
+	var refreshes atomic.Int32
+	// the margin exceeds the one hour lifetime of the refreshed tokens
+	manager := newTestManager(store, 2*time.Hour, &refreshes)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 1500*time.Millisecond)
+	defer cancel()
+	manager.Run(ctx)
+	if refreshes.Load() != 1 {
+		t.Fatalf("refreshes = %d, want 1", refreshes.Load())
+	}
+	if margin := manager.refreshMargin(); margin > 30*time.Minute {
+		t.Fatalf("refreshMargin() = %s", margin)
+	}
+}
+
+func TestManagerReportsRefreshErrors(t *testing.T) {
+	manager := NewManager(&MemoryStore{}, time.Minute)
+	failure := errors.New("sign-in failed")
+	manager.refresh = func(context.Context, Token) (Token, error) { return Token{}, failure }
+	if _, err := manager.Token(t.Context()); !errors.Is(err, failure) {
+		t.Fatalf("Token() error = %v", err)
+	}
+
+	// a caller waiting for another refresh gives up with its context
+	manager.lock <- struct{}{}
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := manager.Token(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Token() error = %v", err)
+	}
+}
+
+func TestManagerWithoutLogin(t *testing.T) {
+	manager := NewManager(&MemoryStore{}, time.Minute)
+	manager.DisableLogin()
+	if _, err := manager.Token(t.Context()); !errors.Is(err, ErrInteractionRequired) {
+		t.Fatalf("Token() error = %v", err)
+	}
+}
+
+func TestManagerLoginStopsWithContext(t *testing.T) {
+	manager := NewManager(&MemoryStore{}, time.Minute)
+	manager.login = func(ctx context.Context) (Token, error) {
+		<-ctx.Done()
+		return Token{}, ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := manager.Token(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Token() error = %v", err)
+	}
+}
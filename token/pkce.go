@@ -0,0 +1,145 @@
+package token
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// loginTimeout bounds how long the browser login waits for the redirect.
+const loginTimeout = 5 * time.Minute
+
+// openURL shows the authorize URL to the user. It is replaced in tests.
+var openURL = func(authorizeURL string) {
+	log.Println("Please open " + authorizeURL + " in a browser on this machine and sign in")
+}
+
+// interactiveLogin signs the user in with the flow selected by LOGIN_MODE:
+// "device" (default) uses the device code flow, "browser" the authorization
+// code flow with PKCE, for tenants that block the device code flow.
+func interactiveLogin(ctx context.Context) (Token, error) {
+	switch mode := strings.ToLower(settings.LoginMode); mode {
+	case "", "device":
+		return requestRefreshToken(ctx)
+	case "browser":
+		return requestAuthorizationCode(ctx)
+	default:
+		return Token{}, fmt.Errorf("unknown LOGIN_MODE %q", mode)
+	}
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type authorizationResult struct {
+	code string
+	err  error
+}
+
+// requestAuthorizationCode signs the user in with the authorization code
+// flow with PKCE. The identity platform redirects the browser to a listener
+// on the loopback interface, the port can be fixed with LOGIN_REDIRECT_PORT.
+func requestAuthorizationCode(ctx context.Context) (Token, error) {
+	verifier, err := randomString()
+	if err != nil {
+		return Token{}, err
+	}
+	state, err := randomString()
+	if err != nil {
+		return Token{}, err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	port := settings.RedirectPort
+	if port == "" {
+		port = "0"
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		return Token{}, fmt.Errorf("start login listener: %w", err)
+	}
+	redirectURI := fmt.Sprintf("http://127.0.0.1:%d/", listener.Addr().(*net.TCPAddr).Port)
+
+	results := make(chan authorizationResult, 1)
+	server := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			if r.URL.Path != "/" || (query.Get("code") == "" && query.Get("error") == "") {
+				http.NotFound(w, r)
+				return
+			}
+			var result authorizationResult
+			switch {
+			case query.Get("state") != state:
+				result.err = errors.New("login redirect has an unexpected state")
+			case query.Get("error") != "":
+				result.err = &AuthError{StatusCode: http.StatusBadRequest, Code: query.Get("error"), Description: query.Get("error_description")}
+			default:
+				result.code = query.Get("code")
+			}
+			if result.err != nil {
+				http.Error(w, "Sign-in failed: "+result.err.Error(), http.StatusBadRequest)
+			} else {
+				fmt.Fprintln(w, "Signed in, you can close this window.")
+			}
+			select {
+			case results <- result:
+			default:
+			}
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	authorize := url.Values{}
+	authorize.Set("client_id", get(settings.ClientID))
+	authorize.Set("response_type", "code")
+	authorize.Set("redirect_uri", redirectURI)
+	authorize.Set("response_mode", "query")
+	authorize.Set("scope", get(settings.Scopes))
+	authorize.Set("state", state)
+	authorize.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	authorize.Set("code_challenge_method", "S256")
+	openURL(endpoint("authorize") + "?" + authorize.Encode())
+
+	var result authorizationResult
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		return Token{}, ctx.Err()
+	case <-time.After(loginTimeout):
+		return Token{}, fmt.Errorf("no sign-in within %s: %w", loginTimeout, ErrInteractionRequired)
+	}
+	if result.err != nil {
+		return Token{}, result.err
+	}
+
+	payloadData := url.Values{}
+	payloadData.Set("grant_type", "authorization_code")
+	payloadData.Set("client_id", get(settings.ClientID))
+	payloadData.Set("scope", get(settings.Scopes))
+	payloadData.Set("code", result.code)
+	payloadData.Set("redirect_uri", redirectURI)
+	payloadData.Set("code_verifier", verifier)
+	var response tokenResponse
+	if err := postForm(ctx, httpClient, endpoint("token"), payloadData, &response); err != nil {
+		return Token{}, fmt.Errorf("redeem authorization code: %w", err)
+	}
+	log.Println("Token received")
+	return response.token()
+}
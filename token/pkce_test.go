@@ -0,0 +1,97 @@
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeAuthorizationServer signs the user in without interaction and checks
+// the PKCE verifier when the code is redeemed. With denied set, the user
+// declines the consent.
+func fakeAuthorizationServer(t *testing.T, denied bool) {
+	t.Helper()
+	var challenge, redirectURI string
+	useFakeAuthority(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/contoso/oauth2/v2.0/authorize":
+			if r.Form.Get("client_id") != "client" || r.Form.Get("response_type") != "code" || r.Form.Get("code_challenge_method") != "S256" {
+				t.Errorf("authorize request %v", r.Form)
+			}
+			challenge = r.Form.Get("code_challenge")
+			redirectURI = r.Form.Get("redirect_uri")
+			redirect, _ := url.Parse(redirectURI)
+			query := url.Values{"state": {r.Form.Get("state")}}
+			if denied {
+				query.Set("error", "access_denied")
+				query.Set("error_description", "AADSTS65004: User declined to consent to access the app.")
+			} else {
+				query.Set("code", "authorization-code")
+			}
+			redirect.RawQuery = query.Encode()
+			http.Redirect(w, r, redirect.String(), http.StatusFound)
+		case "/contoso/oauth2/v2.0/token":
+			sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+			if r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("code") != "authorization-code" ||
+				r.Form.Get("redirect_uri") != redirectURI || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"invalid_grant"}`)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"access","refresh_token":"refresh","expires_in":3600}`)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+		}
+	})
+	previousOpenURL := openURL
+	openURL = func(authorizeURL string) {
+		// the browser follows the redirect to the loopback listener
+		go func() {
+			resp, err := http.Get(authorizeURL)
+			if err != nil {
+				t.Errorf("browser: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	t.Cleanup(func() { openURL = previousOpenURL })
+}
+
+func TestLoginWithAuthorizationCode(t *testing.T) {
+	fakeAuthorizationServer(t, false)
+	settings.LoginMode = "browser"
+	store := &MemoryStore{}
+	manager := NewManager(store, time.Minute)
+	token, err := manager.Login(t.Context())
+	if err != nil || token.Token != "access" || token.RefreshToken != "refresh" {
+		t.Fatalf("Login() = %+v, %v", token, err)
+	}
+	if saved, err := store.Load(); err != nil || saved != token {
+		t.Fatalf("saved = %+v, %v", saved, err)
+	}
+}
+
+func TestLoginWithAuthorizationCodeDeclined(t *testing.T) {
+	fakeAuthorizationServer(t, true)
+	_, err := requestAuthorizationCode(t.Context())
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || authErr.Code != "access_denied" {
+		t.Fatalf("requestAuthorizationCode() error = %v", err)
+	}
+}
+
+func TestInteractiveLoginRejectsUnknownMode(t *testing.T) {
+	previous := settings
+	settings.LoginMode = "carrier-pigeon"
+	defer func() { settings = previous }()
+	if _, err := interactiveLogin(t.Context()); err == nil {
+		t.Fatal("interactiveLogin() succeeded")
+	}
+}
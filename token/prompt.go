@@ -0,0 +1,48 @@
+package token
+
+import (
+	"sync"
+	"time"
+)
+
+// LoginState describes a pending device code login, so the prompt can be
+// shown where a headless bot is watched. When the login ends, Pending is
+// false and Outcome tells how it ended.
+type LoginState struct {
+	Pending         bool
+	VerificationURI string
+	UserCode        string
+	ExpiresAt       time.Time
+	Outcome         LoginOutcome
+}
+
+// LoginOutcome is how a device code login ended.
+type LoginOutcome string
+
+const (
+	LoginSucceeded LoginOutcome = "succeeded"
+	// LoginExpired means the code was not entered in time.
+	LoginExpired LoginOutcome = "expired"
+	// LoginFailed means the login was declined, cancelled or failed.
+	LoginFailed LoginOutcome = "failed"
+)
+
+var loginStateMu sync.Mutex
+var loginStateHandlers []func(LoginState)
+
+// OnLoginState registers a handler that is called when a device code login
+// starts and when it ends.
+func OnLoginState(handler func(LoginState)) {
+	loginStateMu.Lock()
+	defer loginStateMu.Unlock()
+	loginStateHandlers = append(loginStateHandlers, handler)
+}
+
+func notifyLoginState(state LoginState) {
+	loginStateMu.Lock()
+	handlers := loginStateHandlers
+	loginStateMu.Unlock()
+	for _, handler := range handlers {
+		handler(state)
+	}
+}
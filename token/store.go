@@ -0,0 +1,184 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rindula/msteams-presence-bot-go/atomicfile"
+)
+
+// ErrNoToken is returned by a TokenStore that holds no token yet.
+var ErrNoToken = errors.New("no token stored")
+
+// TokenStore persists the token of the signed-in user between runs.
+type TokenStore interface {
+	// Load returns the stored token or ErrNoToken.
+	Load() (Token, error)
+	Save(token Token) error
+	Delete() error
+}
+
+var storeMu sync.Mutex
+var store TokenStore
+
+// SetStore replaces the store used by Default.
+func SetStore(s TokenStore) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	store = s
+}
+
+// currentStore returns the configured store, selected by NewStore on first
+// use.
+func currentStore() (TokenStore, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if store == nil {
+		s, err := NewStore(settings.Store)
+		if err != nil {
+			return nil, err
+		}
+		store = s
+	}
+	return store, nil
+}
+
+// StoreConfig selects a TokenStore.
+type StoreConfig struct {
+	// Kind is "file" (default), "secret" or "memory".
+	Kind string
+	// SecretDir is the directory of the "secret" store.
+	SecretDir string
+	// Passphrase and KeyFile protect the "file" store, see FileStore.
+	Passphrase func() string
+	KeyFile    string
+}
+
+// NewStore returns the store selected by config: "file" keeps the encrypted
+// token in tokenFile, "secret" in the directory SecretDir and "memory" keeps
+// it only while the bot runs.
+func NewStore(config StoreConfig) (TokenStore, error) {
+	switch kind := strings.ToLower(strings.TrimSpace(config.Kind)); kind {
+	case "", "file":
+		store := NewFileStore(tokenFile)
+		store.Passphrase = config.Passphrase
+		if config.KeyFile != "" {
+			store.KeyFile, store.GenerateKey = config.KeyFile, false
+		} else if get(config.Passphrase) == "" {
+			log.Printf("Warning: the token key %s is generated next to the token file and protects it only against reading the token file alone; set TOKEN_PASSPHRASE or TOKEN_KEY_FILE on a separate mount\n", store.KeyFile)
+		}
+		return store, nil
+	case "secret":
+		if config.SecretDir == "" {
+			return nil, fmt.Errorf("TOKEN_SECRET_DIR is required when TOKEN_STORE is secret")
+		}
+		return &SecretDirStore{Dir: config.SecretDir}, nil
+	case "memory":
+		return &MemoryStore{}, nil
+	default:
+		return nil, fmt.Errorf("unknown TOKEN_STORE %q", kind)
+	}
+}
+
+// MemoryStore keeps the token in memory, e.g. for tests.
+type MemoryStore struct {
+	mu    sync.Mutex
+	token *Token
+}
+
+func (s *MemoryStore) Load() (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == nil {
+		return Token{}, ErrNoToken
+	}
+	return *s.token, nil
+}
+
+func (s *MemoryStore) Save(token Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = &token
+	return nil
+}
+
+func (s *MemoryStore) Delete() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = nil
+	return nil
+}
+
+// Names of the files in a SecretDirStore.
+const (
+	secretRefreshToken = "refresh_token"
+	secretAccessToken  = "access_token"
+	secretValidUntil   = "valid_until"
+)
+
+// SecretDirStore keeps the token as one file per value in a directory, the
+// layout of a mounted Kubernetes secret. The refresh token can be provisioned
+// there, the access token is optional. Writing needs a writable mount, e.g. a
+// volume synced back into the secret.
+type SecretDirStore struct {
+	Dir string
+}
+
+func (s *SecretDirStore) read(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(s.Dir, name))
+	return strings.TrimSpace(string(data)), err
+}
+
+func (s *SecretDirStore) Load() (Token, error) {
+	refreshToken, err := s.read(secretRefreshToken)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && refreshToken == "") {
+		return Token{}, ErrNoToken
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	token := Token{RefreshToken: refreshToken}
+	accessToken, err := s.read(secretAccessToken)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Token{}, err
+	}
+	validUntil, err := s.read(secretValidUntil)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Token{}, err
+	}
+	// without a valid expiry the access token is refreshed on first use
+	if seconds, err := strconv.ParseInt(validUntil, 10, 64); err == nil && accessToken != "" {
+		token.Token = accessToken
+		token.ValidUntil = seconds
+	}
+	return token, nil
+}
+
+func (s *SecretDirStore) Save(token Token) error {
+	values := map[string]string{
+		secretRefreshToken: token.RefreshToken,
+		secretAccessToken:  token.Token,
+		secretValidUntil:   strconv.FormatInt(token.ValidUntil, 10),
+	}
+	for name, value := range values {
+		if err := atomicfile.WriteFile(filepath.Join(s.Dir, name), []byte(value)); err != nil {
+			return fmt.Errorf("write %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *SecretDirStore) Delete() error {
+	for _, name := range []string{secretRefreshToken, secretAccessToken, secretValidUntil} {
+		if err := os.Remove(filepath.Join(s.Dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package token
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testStore(t *testing.T, store TokenStore) {
+	t.Helper()
+	if _, err := store.Load(); err != ErrNoToken {
+		t.Fatalf("Load() of an empty store error = %v", err)
+	}
+	want := Token{Token: "access", ValidUntil: 1760000000, RefreshToken: "refresh"}
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Load(); err != nil || got != want {
+		t.Fatalf("Load() = %+v, %v", got, err)
+	}
+	if err := store.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err != ErrNoToken {
+		t.Fatalf("Load() after Delete() error = %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, &MemoryStore{})
+}
+
+func TestSecretDirStore(t *testing.T) {
+	dir := t.TempDir()
+	testStore(t, &SecretDirStore{Dir: dir})
+
+	// a provisioned secret may only contain the refresh token
+	os.WriteFile(filepath.Join(dir, "refresh_token"), []byte("provisioned\n"), 0o600)
+	got, err := (&SecretDirStore{Dir: dir}).Load()
+	if err != nil || got != (Token{RefreshToken: "provisioned"}) {
+		t.Fatalf("Load() = %+v, %v", got, err)
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	keyFileStore := NewFileStore(tokenFile)
+	keyFileStore.KeyFile, keyFileStore.GenerateKey = "/run/secrets/token_key", false
+	tests := []struct {
+		config  StoreConfig
+		want    TokenStore
+		wantErr bool
+	}{
+		{config: StoreConfig{}, want: NewFileStore(tokenFile)},
+		{config: StoreConfig{Kind: "file", KeyFile: "/run/secrets/token_key"}, want: keyFileStore},
+		{config: StoreConfig{Kind: "Memory"}, want: &MemoryStore{}},
+		{config: StoreConfig{Kind: "secret"}, wantErr: true},
+		{config: StoreConfig{Kind: "vault"}, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := NewStore(test.config)
+		if (err != nil) != test.wantErr {
+			t.Fatalf("NewStore(%+v) error = %v", test.config, err)
+		}
+		if err == nil && !sameStore(got, test.want) {
+			t.Fatalf("NewStore(%+v) = %#v", test.config, got)
+		}
+	}
+
+	if got, err := NewStore(StoreConfig{Kind: "secret", SecretDir: "/var/run/secrets/msteams"}); err != nil || got.(*SecretDirStore).Dir != "/var/run/secrets/msteams" {
+		t.Fatalf("NewStore() = %#v, %v", got, err)
+	}
+}
+
+func sameStore(a, b TokenStore) bool {
+	switch a := a.(type) {
+	case *FileStore:
+		b, ok := b.(*FileStore)
+		return ok && a.Path == b.Path && a.KeyFile == b.KeyFile && a.GenerateKey == b.GenerateKey
+	case *MemoryStore:
+		_, ok := b.(*MemoryStore)
+		return ok
+	}
+	return false
+}
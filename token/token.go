@@ -1,16 +1,12 @@
 package token
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/base64"
-	"encoding/gob"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"net/url"
-	"os"
+	"strings"
 	"time"
 )
 
@@ -22,186 +18,125 @@ type Token struct {
 	RefreshToken string
 }
 
-func saveToken(token Token) bool {
-	// Save token to file
-	// try saving token to file
-	fmt.Println("Saving token to file...")
-	file, errCreateFile := os.Create(tokenFile)
-	if errCreateFile != nil {
-		fmt.Println("[pasgka] Error saving token", errCreateFile)
-		return false
-	}
-	defer file.Close()
-
-	b := bytes.Buffer{}
-	e := gob.NewEncoder(&b)
-	errEncode := e.Encode(token)
-	if errEncode != nil {
-		fmt.Println("[snogim] Error saving token", errEncode)
-		return false
-	}
-
-	writer := bufio.NewWriter(file)
-	_, errWrite := writer.WriteString(base64.StdEncoding.EncodeToString(b.Bytes()))
-	if errWrite != nil {
-		fmt.Println("[oseigj] Error saving token", errWrite)
-		return false
-	}
+// authorityHost is the Microsoft identity platform the bot signs in with.
+var authorityHost string = "https://login.microsoftonline.com"
 
-	return true
+func endpoint(name string) string {
+	return fmt.Sprintf("%s/%s/oauth2/v2.0/%s", strings.TrimRight(authorityHost, "/"), get(settings.Tenant), name)
 }
 
-func GetToken() Token {
-	var token Token
-
-	// Get token from file
-	fileContent, err := os.ReadFile(tokenFile)
-	if err != nil {
-		log.Println("[siogre] Error reading token file:", err)
-		requestToken(&Token{})
-		return GetToken()
-	}
-
-	decoded, errDecode := base64.StdEncoding.DecodeString(string(fileContent))
-	if errDecode != nil {
-		log.Println("[usieog] Error reading token file:", errDecode)
-		requestToken(&Token{})
-		return GetToken()
-	}
-	b := bytes.Buffer{}
-	b.Write(decoded)
-	d := gob.NewDecoder(&b)
-	errDecode = d.Decode(&token)
-	if errDecode != nil {
-		log.Println("[srhigf] Error reading token file:", errDecode)
-		requestToken(&Token{})
-		return GetToken()
-	}
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
 
-	// Check if token is valid and not expired
-	if token.ValidUntil < time.Now().Unix() {
-		// request new token
-		return requestToken(&token)
+func (r tokenResponse) token() (Token, error) {
+	if r.AccessToken == "" || r.RefreshToken == "" {
+		return Token{}, errors.New("token response contains no access or refresh token, is offline_access missing in GRAPH_USER_SCOPES?")
 	}
-
-	return token
-
+	return Token{Token: r.AccessToken, ValidUntil: time.Now().Unix() + r.ExpiresIn, RefreshToken: r.RefreshToken}, nil
 }
 
-func requestToken(oldToken *Token) Token {
-	if oldToken.RefreshToken == "" {
-		requestRefreshToken(oldToken)
-	}
+// requestToken redeems the refresh token for a new access token.
+func requestToken(ctx context.Context, refreshToken string) (Token, error) {
 	// request microsoft graph token
 	log.Println("Requesting usable token...")
-	clientId := os.Getenv("CLIENT_ID")
-	scope := os.Getenv("GRAPH_USER_SCOPES")
-	tenantId := os.Getenv("AUTH_TENANT")
-	urlString := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", tenantId)
 	payloadData := url.Values{}
 	payloadData.Set("grant_type", "refresh_token")
-	payloadData.Set("client_id", clientId)
-	payloadData.Set("scope", scope)
-	payloadData.Set("refresh_token", oldToken.RefreshToken)
-	resp, err := http.PostForm(urlString, payloadData)
-	if err != nil {
-		log.Println("[xgjipt] Error requesting token", err)
-		return Token{}
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		var body map[string]interface{}
-		json.NewDecoder(resp.Body).Decode(&body)
-		log.Println("[akfswg] Error requesting token:", resp.Status, body)
-		if oldToken.RefreshToken != "" {
-			t := Token{}
-			return requestToken(&t)
-		} else {
-			return Token{}
-		}
+	payloadData.Set("client_id", get(settings.ClientID))
+	payloadData.Set("scope", get(settings.Scopes))
+	payloadData.Set("refresh_token", refreshToken)
+	var response tokenResponse
+	if err := postForm(ctx, httpClient, endpoint("token"), payloadData, &response); err != nil {
+		return Token{}, fmt.Errorf("refresh token: %w", err)
 	}
+	return response.token()
+}
 
-	var tokenMap map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&tokenMap)
-	var token Token
-	token.RefreshToken = tokenMap["refresh_token"].(string)
-	token.Token = tokenMap["access_token"].(string)
-	token.ValidUntil = time.Now().Unix() + int64(tokenMap["expires_in"].(float64))
-	if !saveToken(token) {
-		log.Println("[rhejil] Error saving token")
-		return Token{}
-	}
-	return token
+type deviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Interval        int64  `json:"interval"`
 }
 
-func requestRefreshToken(oldToken *Token) string {
+// errDeviceCodeExpired is returned when the device code was not entered in
+// time.
+var errDeviceCodeExpired = fmt.Errorf("device code expired: %w", ErrInteractionRequired)
+
+// requestRefreshToken signs the user in with the device code flow and waits
+// until the code was entered or has expired.
+func requestRefreshToken(ctx context.Context) (token Token, err error) {
 	// request microsoft graph token
 	fmt.Println("Requesting refresh token...")
-	clientId := os.Getenv("CLIENT_ID")
-	scope := os.Getenv("GRAPH_USER_SCOPES")
-	tenantId := os.Getenv("AUTH_TENANT")
-	deviceCodeUrl := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/devicecode", tenantId)
 	payloadData := url.Values{}
-	payloadData.Add("client_id", clientId)
-	payloadData.Add("scope", scope)
-	resp, err := http.PostForm(deviceCodeUrl, payloadData)
-	if err != nil {
-		log.Fatalln("[dfiqwc] Error requesting token on device code flow with url", deviceCodeUrl, err)
+	payloadData.Add("client_id", get(settings.ClientID))
+	payloadData.Add("scope", get(settings.Scopes))
+	var deviceCode deviceCodeResponse
+	if err := postForm(ctx, httpClient, endpoint("devicecode"), payloadData, &deviceCode); err != nil {
+		return Token{}, fmt.Errorf("request device code: %w", err)
+	}
+	if deviceCode.DeviceCode == "" || deviceCode.VerificationURI == "" {
+		return Token{}, errors.New("device code response is incomplete")
 	}
-	defer func() {
-		err := resp.Body.Close()
-		if err != nil {
-			log.Fatalln("[dfibet] Error closing response body (refreshtoken)", err)
-		}
-	}()
-
-	var deviceCodeMap map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&deviceCodeMap)
 
-	worksUntil := time.Now().Unix() + int64(deviceCodeMap["expires_in"].(float64))
+	worksUntil := time.Now().Add(time.Duration(deviceCode.ExpiresIn) * time.Second)
+	interval := time.Duration(max(deviceCode.Interval, 1)) * time.Second
 
-	log.Println("Please go to " + deviceCodeMap["verification_uri"].(string) + " and enter the code " + deviceCodeMap["user_code"].(string))
+	log.Println("Please go to " + deviceCode.VerificationURI + " and enter the code " + deviceCode.UserCode)
+	notifyLoginState(LoginState{Pending: true, VerificationURI: deviceCode.VerificationURI, UserCode: deviceCode.UserCode, ExpiresAt: worksUntil})
+	defer func() { notifyLoginState(LoginState{Outcome: loginOutcome(err)}) }()
 	for {
-		// check if token is valid
-		token := checkToken(deviceCodeMap["device_code"].(string))
-		log.Printf("Waiting for %d more seconds", worksUntil-time.Now().Unix())
-		if token != "" {
-			oldToken.RefreshToken = token
+		select {
+		case <-ctx.Done():
+			return Token{}, ctx.Err()
+		case <-time.After(interval):
+		}
+		log.Printf("Waiting for %d more seconds", int(time.Until(worksUntil).Seconds()))
+		token, err := checkToken(ctx, deviceCode.DeviceCode)
+		var authErr *AuthError
+		switch {
+		case err == nil:
 			log.Println("Token received                     ")
-			return token
+			return token, nil
+		case errors.As(err, &authErr) && authErr.Code == "authorization_pending":
+		case errors.As(err, &authErr) && authErr.Code == "slow_down":
+			interval += 5 * time.Second
+		default:
+			return Token{}, err
 		}
-		time.Sleep(time.Duration(deviceCodeMap["interval"].(float64)) * time.Second)
-
-		if time.Now().Unix() > worksUntil {
-			log.Println("Token expired")
-			return ""
+		if time.Now().After(worksUntil) {
+			return Token{}, errDeviceCodeExpired
 		}
 	}
 }
 
-func checkToken(deviceCode string) string {
-	// check if token is valid
-	clientId := os.Getenv("CLIENT_ID")
-	scope := os.Getenv("GRAPH_USER_SCOPES")
-	tenantId := os.Getenv("AUTH_TENANT")
-	tokenUrl := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", tenantId)
+// loginOutcome classifies the error a device code login ended with.
+func loginOutcome(err error) LoginOutcome {
+	var authErr *AuthError
+	switch {
+	case err == nil:
+		return LoginSucceeded
+	case errors.Is(err, errDeviceCodeExpired), errors.As(err, &authErr) && authErr.Code == "expired_token":
+		return LoginExpired
+	default:
+		return LoginFailed
+	}
+}
+
+// checkToken redeems the device code. Until the user entered the code, an
+// *AuthError with the code authorization_pending is returned.
+func checkToken(ctx context.Context, deviceCode string) (Token, error) {
 	payloadData := url.Values{}
 	payloadData.Add("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
-	payloadData.Add("client_id", clientId)
-	payloadData.Add("scope", scope)
+	payloadData.Add("client_id", get(settings.ClientID))
+	payloadData.Add("scope", get(settings.Scopes))
 	payloadData.Add("device_code", deviceCode)
-	resp, err := http.PostForm(tokenUrl, payloadData)
-	if err != nil {
-		log.Fatalln("[ruiurb] Error requesting token", err)
+	var response tokenResponse
+	if err := postForm(ctx, httpClient, endpoint("token"), payloadData, &response); err != nil {
+		return Token{}, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return "" // no token yet, try again in the next run
-	}
-
-	var tokenMap map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&tokenMap)
-	return tokenMap["refresh_token"].(string)
+	return response.token()
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const defaultTopicPrefix = "msteams"
+const defaultDiscoveryPrefix = "homeassistant"
+
+// Topics holds the MQTT topics and Home Assistant identifiers of one bot
+// instance, so several instances can share a broker without overwriting each
+// other's entities.
+type Topics struct {
+	// Base is the prefix of all state and command topics.
+	Base string
+	// DiscoveryPrefix is the Home Assistant discovery prefix.
+	DiscoveryPrefix string
+	// NodeID is used in discovery topics, unique IDs and device identifiers.
+	NodeID string
+}
+
+var nonSlugCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+var validNodeID = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// slug turns a user principal name like jane.doe@contoso.com into an ID that
+// is valid in MQTT topics and Home Assistant node IDs.
+func slug(value string) string {
+	return strings.Trim(nonSlugCharacters.ReplaceAllString(strings.ToLower(value), "_"), "_")
+}
+
+// topicsFromConfig builds the topics from MQTT_BASE_TOPIC,
+// HA_DISCOVERY_PREFIX and HA_NODE_ID. Unset values are derived from the user
+// principal name of the signed-in user.
+func topicsFromConfig(config *Config, userPrincipalName string) (Topics, error) {
+	topics := Topics{
+		Base:            strings.Trim(strings.TrimSpace(config.MQTT.BaseTopic), "/"),
+		DiscoveryPrefix: strings.Trim(strings.TrimSpace(config.HomeAssistant.DiscoveryPrefix), "/"),
+		NodeID:          strings.TrimSpace(config.HomeAssistant.NodeID),
+	}
+	if topics.NodeID == "" {
+		topics.NodeID = slug(userPrincipalName)
+	}
+	if topics.NodeID == "" {
+		return Topics{}, fmt.Errorf("cannot derive a node ID from the user principal name; set HA_NODE_ID")
+	}
+	if !validNodeID.MatchString(topics.NodeID) {
+		return Topics{}, fmt.Errorf("HA_NODE_ID %q may only contain letters, digits, underscores and hyphens", topics.NodeID)
+	}
+	if topics.Base == "" {
+		topics.Base = defaultTopicPrefix + "/" + topics.NodeID
+	}
+	if topics.DiscoveryPrefix == "" {
+		topics.DiscoveryPrefix = defaultDiscoveryPrefix
+	}
+	if strings.ContainsAny(topics.Base+topics.DiscoveryPrefix, "#+") {
+		return Topics{}, fmt.Errorf("MQTT_BASE_TOPIC and HA_DISCOVERY_PREFIX must not contain wildcards")
+	}
+	return topics, nil
+}
+
+func (t Topics) Presence() string {
+	return t.Base + "/presence"
+}
+
+func (t Topics) Version() string {
+	return t.Base + "/version"
+}
+
+func (t Topics) Availability() string {
+	return t.Base + "/availability"
+}
+
+func (t Topics) Connection() string {
+	return t.Base + "/connection"
+}
+
+func (t Topics) Graph() string {
+	return t.Base + "/graph"
+}
+
+func (t Topics) Login() string {
+	return t.Base + "/login"
+}
+
+func (t Topics) LoginEvent() string {
+	return t.Base + "/login/event"
+}
+
+func (t Topics) License() string {
+	return t.Base + "/license"
+}
+
+func (t Topics) LicenseEvent() string {
+	return t.Base + "/license/event"
+}
+
+func (t Topics) PresenceCommand() string {
+	return t.Base + "/presence/set"
+}
+
+func (t Topics) StatusMessageCommand() string {
+	return t.Base + "/status/set"
+}
+
+func (t Topics) StatusMessageClear() string {
+	return t.Base + "/status/clear"
+}
+
+// availability returns the availability entries for discovery configs.
+func (t Topics) availability() []Availability {
+	return []Availability{
+		{Topic: t.Availability(), PayloadAvailable: payloadOnline, PayloadNotAvailable: payloadOffline},
+	}
+}
+
+// loginAvailability marks entities unavailable while a login is pending.
+func (t Topics) loginAvailability() Availability {
+	return Availability{Topic: t.Login(), ValueTemplate: "{{ '" + payloadOffline + "' if value_json.pending else '" + payloadOnline + "' }}"}
+}
+
+// Discovery returns the discovery config topic of an entity.
+func (t Topics) Discovery(component, objectID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", t.DiscoveryPrefix, component, t.NodeID, objectID)
+}
+
+// UniqueID returns the Home Assistant unique ID of an entity.
+func (t Topics) UniqueID(objectID string) string {
+	return "teams_" + t.NodeID + "_" + objectID
+}
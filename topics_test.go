@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestTopicsFromConfig(t *testing.T) {
+	config := &Config{}
+	topics, err := topicsFromConfig(config, "Jane.Doe@contoso.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Topics{Base: "msteams/jane_doe_contoso_com", DiscoveryPrefix: "homeassistant", NodeID: "jane_doe_contoso_com"}); topics != want {
+		t.Fatalf("topics = %+v, want %+v", topics, want)
+	}
+	if got := topics.Discovery("sensor", "availability"); got != "homeassistant/sensor/jane_doe_contoso_com/availability/config" {
+		t.Fatalf("discovery topic = %s", got)
+	}
+	if got := topics.UniqueID("availability"); got != "teams_jane_doe_contoso_com_availability" {
+		t.Fatalf("unique ID = %s", got)
+	}
+
+	config.MQTT.BaseTopic = "/office/teams/"
+	config.HomeAssistant = HomeAssistantConfig{DiscoveryPrefix: "ha", NodeID: "desk-1"}
+	topics, err = topicsFromConfig(config, "jane.doe@contoso.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics.Presence() != "office/teams/presence" || topics.Discovery("select", "presence") != "ha/select/desk-1/presence/config" {
+		t.Fatalf("topics = %+v", topics)
+	}
+
+	config.HomeAssistant.NodeID = "desk 1"
+	if _, err := topicsFromConfig(config, "jane.doe@contoso.com"); err == nil {
+		t.Fatal("invalid node ID was accepted")
+	}
+	config.HomeAssistant.NodeID = ""
+	config.MQTT.BaseTopic = "office/#"
+	if _, err := topicsFromConfig(config, "jane.doe@contoso.com"); err == nil {
+		t.Fatal("wildcard base topic was accepted")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,27 +17,36 @@ type Release struct {
 
 var apiBase string = "https://api.github.com/repos/Rindula/msteams-presence-bot-go"
 
-func updateCheck() {
-	lv, err := _updateCheck()
-	if err != nil {
-		log.Println("Error checking for updates:", err)
-	} else {
-		latestVersion = lv
-	}
+// updateCheck looks for a new release every 15 minutes until ctx is done.
+func updateCheck(ctx context.Context) {
 	ticker := time.NewTicker(15 * time.Minute)
 	defer ticker.Stop()
-	for range ticker.C {
-		lv, err := _updateCheck()
+	for {
+		lv, err := _updateCheck(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			log.Println("Error checking for updates:", err)
 		} else {
 			latestVersion = lv
 		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
-func _updateCheck() (Release, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/releases/latest", apiBase))
+func _updateCheck(ctx context.Context) (Release, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/releases/latest", apiBase), nil)
+	if err != nil {
+		return Release{}, fmt.Errorf("error checking for updates: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.Println("Error checking for updates", err)
 		return Release{}, fmt.Errorf("error checking for updates: %w", err)